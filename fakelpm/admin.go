@@ -0,0 +1,422 @@
+package fakelpm
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// AdminHandler returns the HTTP/JSON API controlling the running server:
+//
+//	GET    /connections                             active connections
+//	DELETE /connections/{remote}                    close a connection
+//	GET    /faults                                  fault injection rules
+//	PUT    /faults                                  replace them, {"faults": [...]} as a scenario file
+//	GET    /clock                                   simulated time
+//	POST   /clock/advance                           {"duration": "2h"}
+//	GET    /plants                                  plants and their poles
+//	POST   /plants/{plant}/poles                    add a pole, {"address": 21, "voltage": 230, ...}
+//	DELETE /plants/{plant}/poles/{address}          remove a pole
+//	PUT    /plants/{plant}/poles/{address}/faults   {"faults": ["led_plate_open_circuit"], "not_responding": false}
+//	GET    /plants/{plant}/history?user=U&after=N   history records, after the cursor of U when given
+//	DELETE /plants/{plant}/history                  drop the history records
+//
+// Errors are answered with {"error": "..."}.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", s.adminConnections)
+	mux.HandleFunc("DELETE /connections/{remote}", s.adminDisconnect)
+	mux.HandleFunc("GET /faults", s.adminFaults)
+	mux.HandleFunc("PUT /faults", s.adminSetFaults)
+	mux.HandleFunc("GET /clock", s.adminClock)
+	mux.HandleFunc("POST /clock/advance", s.adminAdvance)
+	mux.HandleFunc("GET /plants", s.adminPlants)
+	mux.HandleFunc("POST /plants/{plant}/poles", s.adminAddPole)
+	mux.HandleFunc("DELETE /plants/{plant}/poles/{address}", s.adminRemovePole)
+	mux.HandleFunc("PUT /plants/{plant}/poles/{address}/faults", s.adminForceFaults)
+	mux.HandleFunc("GET /plants/{plant}/history", s.adminHistory)
+	mux.HandleFunc("DELETE /plants/{plant}/history", s.adminClearHistory)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Admin: failed to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	return nil
+}
+
+// AdminConnection is a connection listed by the admin API
+type AdminConnection struct {
+	Remote string `json:"remote"`
+	Local  string `json:"local"`
+}
+
+func (s *Server) adminConnections(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	conns := make([]AdminConnection, 0, len(s.Connections))
+	for conn := range s.Connections {
+		conns = append(conns, AdminConnection{Remote: conn.RemoteAddr().String(), Local: conn.LocalAddr().String()})
+	}
+	s.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Remote < conns[j].Remote })
+	writeJSON(w, http.StatusOK, conns)
+}
+
+func (s *Server) adminDisconnect(w http.ResponseWriter, r *http.Request) {
+	remote := r.PathValue("remote")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.Connections {
+		if conn.RemoteAddr().String() == remote {
+			log.Printf("Admin: closing connection from %s", remote)
+			conn.Close()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("no connection from %s", remote))
+}
+
+func (s *Server) adminFaults(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, FaultScenario{Faults: s.Faults.Faults()})
+}
+
+func (s *Server) adminSetFaults(w http.ResponseWriter, r *http.Request) {
+	var scenario FaultScenario
+	if err := readJSON(r, &scenario); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	for i, f := range scenario.Faults {
+		if err := f.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("fault %d: %v", i, err))
+			return
+		}
+	}
+	s.Faults.SetFaults(scenario.Faults)
+	log.Printf("Admin: %d fault rules set", len(scenario.Faults))
+	for _, f := range scenario.Faults {
+		log.Printf("Fault injection enabled: %s", f)
+	}
+	writeJSON(w, http.StatusOK, scenario)
+}
+
+type adminClock struct {
+	Now time.Time `json:"now"`
+}
+
+func (s *Server) adminClock(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, adminClock{Now: s.Clock.Now()})
+}
+
+func (s *Server) adminAdvance(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Duration Duration `json:"duration"`
+	}
+	if err := readJSON(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.Duration <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("duration must be positive"))
+		return
+	}
+	clock, ok := s.Clock.(SteppedClock)
+	if !ok {
+		writeError(w, http.StatusConflict, errors.New("the server clock cannot be advanced"))
+		return
+	}
+	clock.Advance(time.Duration(body.Duration))
+	now := clock.Now()
+	log.Printf("Admin: simulated clock advanced by %s to %s", time.Duration(body.Duration), now.Format(time.RFC3339))
+	writeJSON(w, http.StatusOK, adminClock{Now: now})
+}
+
+// AdminPlant is a plant listed by the admin API
+type AdminPlant struct {
+	Code     string      `json:"code"`
+	Location string      `json:"location"`
+	Poles    []AdminPole `json:"poles"`
+}
+
+// AdminPole is a pole listed by the admin API, its nominal values, counters
+// and forced faults
+type AdminPole struct {
+	Address             int      `json:"address"`
+	Voltage             float64  `json:"voltage"`
+	Current             float64  `json:"current"`
+	Cosfi               float64  `json:"cosfi"`
+	Energy              float64  `json:"energy"`
+	Powered             Duration `json:"powered"`
+	Lit                 Duration `json:"lit"`
+	ForcedFaults        []string `json:"forced_faults"`
+	ForcedNotResponding bool     `json:"forced_not_responding"`
+}
+
+// adminPlants returns the plants of the server, the default one first
+func (s *Server) adminPlants(w http.ResponseWriter, r *http.Request) {
+	plants := []AdminPlant{}
+	for _, p := range s.allPlants() {
+		plants = append(plants, p.admin())
+	}
+	writeJSON(w, http.StatusOK, plants)
+}
+
+func (s *Server) allPlants() []*Plant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var plants []*Plant
+	if s.Plant != nil {
+		plants = append(plants, s.Plant)
+	}
+	codes := make([]string, 0, len(s.Plants))
+	for code := range s.Plants {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		if p := s.Plants[code]; p != s.Plant {
+			plants = append(plants, p)
+		}
+	}
+	return plants
+}
+
+func (p *Plant) admin() AdminPlant {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ap := AdminPlant{Code: p.Code, Location: p.Location.String(), Poles: []AdminPole{}}
+	for _, pole := range p.poles {
+		ap.Poles = append(ap.Poles, AdminPole{
+			Address:             pole.Address,
+			Voltage:             pole.Voltage,
+			Current:             pole.Current,
+			Cosfi:               pole.Cosfi,
+			Energy:              pole.Energy,
+			Powered:             Duration(pole.Powered),
+			Lit:                 Duration(pole.Lit),
+			ForcedFaults:        pole.ForcedFaults.Names(),
+			ForcedNotResponding: pole.ForcedNotResponding,
+		})
+	}
+	return ap
+}
+
+// adminPlant returns the plant named in the request path
+func (s *Server) adminPlant(w http.ResponseWriter, r *http.Request) *Plant {
+	code := r.PathValue("plant")
+	for _, p := range s.allPlants() {
+		if p.Code == code {
+			return p
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("no plant %q", code))
+	return nil
+}
+
+// adminPole returns the plant and the pole address named in the request path
+func (s *Server) adminPole(w http.ResponseWriter, r *http.Request) (*Plant, int) {
+	p := s.adminPlant(w, r)
+	if p == nil {
+		return nil, 0
+	}
+	address, err := strconv.Atoi(r.PathValue("address"))
+	if err != nil || address < 1 || address > 9999 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid pole address %q", r.PathValue("address")))
+		return nil, 0
+	}
+	return p, address
+}
+
+func (s *Server) adminAddPole(w http.ResponseWriter, r *http.Request) {
+	p := s.adminPlant(w, r)
+	if p == nil {
+		return
+	}
+	var body struct {
+		Address int     `json:"address"`
+		Voltage float64 `json:"voltage"`
+		Current float64 `json:"current"`
+		Cosfi   float64 `json:"cosfi"`
+	}
+	if err := readJSON(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Addresses are 4 BCD digits in a Data block
+	if body.Address == 0 {
+		for _, pole := range p.Poles() {
+			body.Address = max(body.Address, pole.Address)
+		}
+		body.Address++
+	}
+	if body.Address < 1 || body.Address > 9999 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid pole address %d", body.Address))
+		return
+	}
+	for _, pole := range p.Poles() {
+		if pole.Address == body.Address {
+			writeError(w, http.StatusConflict, fmt.Errorf("plant %s already has pole %d", p.Code, body.Address))
+			return
+		}
+	}
+
+	pole := p.RandomPole(body.Address)
+	if body.Voltage > 0 {
+		pole.Voltage = body.Voltage
+	}
+	if body.Current > 0 {
+		pole.Current = body.Current
+	}
+	if body.Cosfi > 0 {
+		pole.Cosfi = body.Cosfi
+	}
+	// The pole is installed now, it has no past nights to report
+	pole.updated = s.Clock.Now().In(p.Location)
+	p.AddPole(pole)
+	log.Printf("Admin: pole %d added to plant %s", pole.Address, p.Code)
+	writeJSON(w, http.StatusCreated, map[string]int{"address": pole.Address})
+}
+
+func (s *Server) adminRemovePole(w http.ResponseWriter, r *http.Request) {
+	p, address := s.adminPole(w, r)
+	if p == nil {
+		return
+	}
+	if !p.RemovePole(address) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("plant %s has no pole %d", p.Code, address))
+		return
+	}
+	log.Printf("Admin: pole %d removed from plant %s", address, p.Code)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminForceFaults(w http.ResponseWriter, r *http.Request) {
+	p, address := s.adminPole(w, r)
+	if p == nil {
+		return
+	}
+	var body struct {
+		Faults        []string `json:"faults"`
+		NotResponding bool     `json:"not_responding"`
+	}
+	if err := readJSON(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	faults, err := ParseLampFlags(body.Faults)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if faults.Has(LampPowerOn) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%s is a state, not a fault", LPM_lamp_measure_lamp_power_on))
+		return
+	}
+	if !p.ForceFaults(address, faults, body.NotResponding) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("plant %s has no pole %d", p.Code, address))
+		return
+	}
+	log.Printf("Admin: pole %d of plant %s forced to faults %s, not responding %v", address, p.Code, faults, body.NotResponding)
+	writeJSON(w, http.StatusOK, body)
+}
+
+// AdminRecord is a history record listed by the admin API, with the readings
+// decoded from its Data block
+type AdminRecord struct {
+	Seq      uint64                   `json:"seq"`
+	Produced time.Time                `json:"produced"`
+	Data     string                   `json:"data"` // hex
+	Readings []map[string]interface{} `json:"readings,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+func (s *Server) adminHistory(w http.ResponseWriter, r *http.Request) {
+	p := s.adminPlant(w, r)
+	if p == nil {
+		return
+	}
+
+	var after uint64
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid after %q", v))
+			return
+		}
+	}
+	if v := r.URL.Query().Get("user"); v != "" {
+		user, err := ParseCode(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid user code: %v", err))
+			return
+		}
+		cursor, err := s.History.Cursor(string(user[:]), p.Code)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		after = max(after, cursor)
+	}
+
+	// The history is otherwise only brought up to date by requests
+	if err := s.update(p); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	records, err := s.History.Records(p.Code, after, 0)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	result := make([]AdminRecord, 0, len(records))
+	for _, rec := range records {
+		ar := AdminRecord{Seq: rec.Seq, Produced: rec.Produced, Data: hex.EncodeToString(rec.Data[:])}
+		readings, err := DecodeLampBlock(rec.Data[:], p.Location)
+		if err != nil {
+			ar.Error = err.Error()
+		}
+		for _, reading := range readings {
+			ar.Readings = append(ar.Readings, reading.Map())
+		}
+		result = append(result, ar)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) adminClearHistory(w http.ResponseWriter, r *http.Request) {
+	p := s.adminPlant(w, r)
+	if p == nil {
+		return
+	}
+	if err := s.History.Clear(p.Code); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("Admin: history of plant %s cleared", p.Code)
+	w.WriteHeader(http.StatusNoContent)
+}
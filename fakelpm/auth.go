@@ -0,0 +1,95 @@
+package fakelpm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Credential is a UserCode/PlantCode pair allowed to download from a Server
+type Credential struct {
+	UserCode  string `json:"user"`
+	PlantCode string `json:"plant"`
+}
+
+func (c Credential) String() string {
+	return c.UserCode + ":" + c.PlantCode
+}
+
+// ParseCredential parses a credential written as user:plant
+func ParseCredential(s string) (Credential, error) {
+	user, plant, ok := strings.Cut(s, ":")
+	if !ok {
+		return Credential{}, fmt.Errorf("invalid credential %q, expected user:plant", s)
+	}
+	return normalizeCredential(Credential{UserCode: user, PlantCode: plant})
+}
+
+// normalizeCredential pads the codes as ParseCode does, so they compare equal
+// to the request fields
+func normalizeCredential(c Credential) (Credential, error) {
+	user, err := ParseCode(c.UserCode)
+	if err != nil {
+		return c, fmt.Errorf("invalid user code: %v", err)
+	}
+	plant, err := ParseCode(c.PlantCode)
+	if err != nil {
+		return c, fmt.Errorf("invalid plant code: %v", err)
+	}
+	return Credential{UserCode: string(user[:]), PlantCode: string(plant[:])}, nil
+}
+
+// RejectAction is what a Server does with a request carrying unknown codes
+type RejectAction string
+
+const (
+	RejectNAK   RejectAction = "nak"   // answer with a NAK, the connection stays open
+	RejectClose RejectAction = "close" // close the connection
+)
+
+func ParseRejectAction(s string) (RejectAction, error) {
+	switch a := RejectAction(strings.ToLower(s)); a {
+	case RejectNAK, RejectClose:
+		return a, nil
+	case "":
+		return RejectNAK, nil
+	}
+	return "", fmt.Errorf("unknown reject action %q", s)
+}
+
+// SetCredentials restricts downloads to the given UserCode/PlantCode pairs,
+// none means any request is accepted
+func (s *Server) SetCredentials(credentials []Credential) error {
+	allowed := make(map[Credential]bool, len(credentials))
+	for _, c := range credentials {
+		nc, err := normalizeCredential(c)
+		if err != nil {
+			return fmt.Errorf("credential %s: %v", c, err)
+		}
+		allowed[nc] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credentials = allowed
+	return nil
+}
+
+// Credentials returns the UserCode/PlantCode pairs allowed to download
+func (s *Server) Credentials() []Credential {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	credentials := make([]Credential, 0, len(s.credentials))
+	for c := range s.credentials {
+		credentials = append(credentials, c)
+	}
+	return credentials
+}
+
+func (s *Server) authorized(req *Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.credentials) == 0 {
+		return true
+	}
+	return s.credentials[Credential{UserCode: string(req.UserCode[:]), PlantCode: string(req.PlantCode[:])}]
+}
@@ -0,0 +1,195 @@
+package fakelpm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// Direction tells which peer sent the bytes of a CaptureEntry
+type Direction string
+
+const (
+	ClientToServer Direction = "c2s"
+	ServerToClient Direction = "s2c"
+)
+
+// Capture events, an entry without event carries data
+const (
+	CaptureOpen  = "open"  // the client connected
+	CaptureClose = "close" // Dir tells which peer closed the connection
+)
+
+// HexBytes is a byte slice read from and written to JSON as a hex string
+type HexBytes []byte
+
+func (h HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+func (h *HexBytes) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("hex data must be a string: %v", err)
+	}
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*h = data
+	return nil
+}
+
+// CaptureEntry is a line of a capture file. Data holds the bytes of a single
+// read from the sender, which is usually exactly one frame as both peers
+// write a frame at a time; Frames lists the frame types found in it.
+type CaptureEntry struct {
+	Time   time.Time `json:"time"`
+	Conn   int       `json:"conn"`
+	Dir    Direction `json:"dir,omitempty"`
+	Event  string    `json:"event,omitempty"`
+	Data   HexBytes  `json:"data,omitempty"`
+	Frames []string  `json:"frames,omitempty"`
+}
+
+// frameTypes lists the types of the frames in data, for information
+func frameTypes(data []byte) []string {
+	var types []string
+	fr := NewFrameReader(bytes.NewReader(data))
+	for {
+		frame, err := fr.ReadFrame()
+		var ferr *FrameError
+		if errors.As(err, &ferr) {
+			types = append(types, "invalid "+ferr.Type.String())
+			continue
+		}
+		if err != nil {
+			return types
+		}
+		types = append(types, frame.Type.String())
+	}
+}
+
+// CaptureWriter writes capture entries as JSON lines. It is safe for use by
+// concurrent connections.
+type CaptureWriter struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func NewCaptureWriter(w io.Writer) *CaptureWriter {
+	bw := bufio.NewWriter(w)
+	return &CaptureWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+// Write appends an entry to the capture and flushes it, so that the capture
+// is complete up to the last entry if the process is killed
+func (cw *CaptureWriter) Write(e CaptureEntry) error {
+	if e.Event == "" && e.Frames == nil {
+		e.Frames = frameTypes(e.Data)
+	}
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if err := cw.enc.Encode(e); err != nil {
+		return err
+	}
+	return cw.w.Flush()
+}
+
+// AppendCapture opens a capture file for appending, creating it if needed,
+// and returns the highest connection number already in it so that new
+// sessions can be numbered after those of earlier runs
+func AppendCapture(path string) (*os.File, int, error) {
+	var last int
+	c, err := LoadCapture(path)
+	switch {
+	case err == nil:
+		for _, conn := range c.Conns() {
+			last = max(last, conn)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, 0, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, last, nil
+}
+
+// Capture is a recorded set of sessions
+type Capture struct {
+	Entries []CaptureEntry
+}
+
+// ReadCapture reads a capture in JSON lines form
+func ReadCapture(r io.Reader) (*Capture, error) {
+	var c Capture
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e CaptureEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		c.Entries = append(c.Entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// LoadCapture reads a capture file
+func LoadCapture(path string) (*Capture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := ReadCapture(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid capture %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Conns returns the numbers of the captured connections in order of
+// appearance
+func (c *Capture) Conns() []int {
+	var conns []int
+	seen := make(map[int]bool)
+	for _, e := range c.Entries {
+		if !seen[e.Conn] {
+			seen[e.Conn] = true
+			conns = append(conns, e.Conn)
+		}
+	}
+	return conns
+}
+
+// Session returns the entries of a captured connection
+func (c *Capture) Session(conn int) []CaptureEntry {
+	var entries []CaptureEntry
+	for _, e := range c.Entries {
+		if e.Conn == conn {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,38 @@
+package fakelpm
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAppendCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+
+	// Two runs appending to the same file, numbering from what is there
+	for run := 0; run < 2; run++ {
+		f, last, err := AppendCapture(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := run * 2; last != want {
+			t.Fatalf("run %d: last connection %d, want %d", run, last, want)
+		}
+
+		cw := NewCaptureWriter(f)
+		for conn := last + 1; conn <= last+2; conn++ {
+			if err := cw.Write(CaptureEntry{Time: time.Now(), Conn: conn, Event: CaptureOpen}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f.Close()
+	}
+
+	c, err := LoadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conns := c.Conns(); len(conns) != 4 || conns[3] != 4 {
+		t.Fatalf("got connections %v, want 1 to 4", conns)
+	}
+}
@@ -2,45 +2,104 @@ package fakelpm
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
+	"iter"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
+// Default client timeouts, 0 disables a timeout
+const (
+	DefaultDialTimeout  = 10 * time.Second
+	DefaultFrameTimeout = 30 * time.Second
+)
+
+// DefaultSkewThreshold is the concentrator clock skew, either way, beyond
+// which a client raises an alert
+const DefaultSkewThreshold = 5 * time.Minute
+
 type Client struct {
 	ServerAddr string
+	userCode   [4]byte
+	plantCode  [4]byte
 	conn       net.Conn
-	timeout    time.Duration
+	fr         *FrameReader
+	maxRec     int
+	blockSel   byte
+	maxRetries int
+
+	dialTimeout     time.Duration
+	frameTimeout    time.Duration
+	downloadTimeout time.Duration
+
+	// Interrupted download state used by Resume: the command letter of the
+	// download (0 when the last one completed) and the last block handled
+	interrupted byte
+	lastBlock   *[48]byte
+
+	// Time zone of the concentrator, handling of its clock skew and what
+	// its last Header told, guarded by headerMu
+	location      *time.Location
+	skewThreshold time.Duration
+	correctSkew   bool
+	headerMu      sync.Mutex
+	header        *HeaderInfo
+	skew          time.Duration
+
+	Stats Stats
 }
 
 func NewClient(serverAddr string) *Client {
-	return &Client{ServerAddr: serverAddr}
+	return &Client{
+		ServerAddr:    serverAddr,
+		userCode:      [4]byte{'0', '0', '0', '0'},
+		plantCode:     [4]byte{'0', '0', '0', '0'},
+		blockSel:      BlockSelMeasures,
+		maxRetries:    DefaultMaxRetries,
+		dialTimeout:   DefaultDialTimeout,
+		frameTimeout:  DefaultFrameTimeout,
+		location:      time.Local,
+		skewThreshold: DefaultSkewThreshold,
+	}
 }
 
 func (c *Client) Connect() error {
-	conn, err := net.Dial("tcp", c.ServerAddr)
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext dials the server and waits for its welcome ACK. The dial
+// timeout and the context bound the dial, the frame timeout and the context
+// bound the wait for the ACK.
+func (c *Client) ConnectContext(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: c.dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.ServerAddr)
 	if err != nil {
 		return fmt.Errorf("connection failed: %v", err)
 	}
 	c.conn = conn
+	c.fr = NewFrameReader(conn)
+
+	stop := c.watch(ctx)
+	defer stop()
 
 	// Read ACK
-	ack := make([]byte, 11)
-	n, err := conn.Read(ack)
+	ack, err := c.readFrame(ctx)
 	if err != nil {
 		conn.Close()
 		return fmt.Errorf("failed to read ACK: %v", err)
 	}
-
-	// Reset timeout
-	conn.SetReadDeadline(time.Time{})
+	if ack.Type != FrameACK {
+		conn.Close()
+		return fmt.Errorf("expected welcome ACK, got %s frame", ack.Type)
+	}
 
 	log.Printf("Connected to %s", c.ServerAddr)
-	log.Printf("received Welcome ACK: %q", ack[:n])
+	log.Printf("received Welcome ACK: %q", ack.Raw)
 	return nil
 }
 
@@ -51,200 +110,437 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// SetTimeout sets both the dial and the per-frame timeout
 func (c *Client) SetTimeout(timeout time.Duration) {
-	c.timeout = timeout
+	c.dialTimeout = timeout
+	c.frameTimeout = timeout
 }
 
-func (c *Client) SendDownloadRequest(isTotal bool) (*Header, []*Measurement, error) {
-	if c.conn == nil {
-		return nil, nil, fmt.Errorf("not connected to server")
-	}
+// SetDialTimeout bounds the time taken to open the connection
+func (c *Client) SetDialTimeout(timeout time.Duration) {
+	c.dialTimeout = timeout
+}
 
-	request := NewRequest()
-	if isTotal {
-		request.Command[1] = 0x54 // 'T'
-	} else {
-		request.Command[1] = 0x50 // 'P'
+// SetFrameTimeout bounds every single read or write on the connection
+func (c *Client) SetFrameTimeout(timeout time.Duration) {
+	c.frameTimeout = timeout
+}
+
+// SetDownloadTimeout bounds a whole download, from request to final package
+func (c *Client) SetDownloadTimeout(timeout time.Duration) {
+	c.downloadTimeout = timeout
+}
+
+// SetUserCode sets the UserCode sent with download requests, see ParseCode
+func (c *Client) SetUserCode(code string) error {
+	b, err := ParseCode(code)
+	if err != nil {
+		return fmt.Errorf("invalid user code: %v", err)
 	}
-	request.CalculateRequestChecksum()
+	c.userCode = b
+	return nil
+}
 
-	// Send request
-	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
-	_, err := c.conn.Write(request.Bytes())
-	c.conn.SetWriteDeadline(time.Time{})
+// SetPlantCode sets the PlantCode sent with download requests, see ParseCode
+func (c *Client) SetPlantCode(code string) error {
+	b, err := ParseCode(code)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to send request: %v", err)
+		return fmt.Errorf("invalid plant code: %v", err)
 	}
-	log.Printf("Sent %s request", string(request.Command[:]))
+	c.plantCode = b
+	return nil
+}
 
-	// Read ACK response
-	/*
-		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
-		ackBuf := make([]byte, 11)
-		_, err = c.conn.Read(ackBuf)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to read ACK: %v", err)
-		}
-		log.Printf("Received ACK response")
-	*/
+// UserCode returns the UserCode sent with download requests
+func (c *Client) UserCode() string {
+	return string(c.userCode[:])
+}
 
-	// Read header block
-	headerBuf := make([]byte, 35)
-	_, err = c.conn.Read(headerBuf)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read header block: %v", err)
+// PlantCode returns the PlantCode sent with download requests
+func (c *Client) PlantCode() string {
+	return string(c.plantCode[:])
+}
+
+// SetLocation sets the time zone of the concentrator clock, the local one by
+// default
+func (c *Client) SetLocation(loc *time.Location) {
+	c.location = loc
+}
+
+// Location returns the time zone of the concentrator clock
+func (c *Client) Location() *time.Location {
+	return c.location
+}
+
+// SetSkewThreshold sets the concentrator clock skew, either way, beyond which
+// an alert is raised; any skew is beyond a threshold of 0
+func (c *Client) SetSkewThreshold(d time.Duration) {
+	c.skewThreshold = d
+}
+
+// SetCorrectSkew makes Records move reading timestamps back by the
+// concentrator clock skew, when it is beyond the threshold
+func (c *Client) SetCorrectSkew(correct bool) {
+	c.correctSkew = correct
+}
+
+// HeaderInfo returns the last Header received, ok is false when none was
+// received or it could not be decoded
+func (c *Client) HeaderInfo() (info HeaderInfo, ok bool) {
+	c.headerMu.Lock()
+	defer c.headerMu.Unlock()
+	if c.header == nil {
+		return HeaderInfo{}, false
 	}
+	return *c.header, true
+}
+
+// ClockSkew returns how far the concentrator clock was ahead of the local
+// clock when the last Header was received, negative when it was behind. The
+// Header has minute precision, and so has the skew.
+func (c *Client) ClockSkew() (skew time.Duration, ok bool) {
+	c.headerMu.Lock()
+	defer c.headerMu.Unlock()
+	return c.skew, c.header != nil
+}
 
-	// Verify header checksum
-	var calculatedSum uint16
-	for _, b := range headerBuf[1:32] {
-		calculatedSum += uint16(b)
+// skewed tells whether skew is beyond the threshold
+func (c *Client) skewed(skew time.Duration) bool {
+	return skew > c.skewThreshold || skew < -c.skewThreshold
+}
+
+// Records decodes the Data block of m, downloaded from target, into records.
+// With SetCorrectSkew their timestamps are moved back by the clock skew of
+// the last Header, when it is beyond the threshold.
+func (c *Client) Records(target string, m *Measurement) ([]Record, error) {
+	records, err := NewRecords(target, c.UserCode(), c.PlantCode(), m, c.location)
+	if err != nil || !c.correctSkew {
+		return records, err
 	}
-	receivedChecksum := binary.BigEndian.Uint16(headerBuf[32:34])
-	log.Printf("Header checksum: calculated=%d, received=%d", calculatedSum, receivedChecksum)
-	header, err := ParseHeader(headerBuf)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse header block: %v", err)
+	skew, ok := c.ClockSkew()
+	if !ok || !c.skewed(skew) {
+		return records, nil
 	}
+	for i := range records {
+		records[i].Timestamp = records[i].Timestamp.Add(-skew)
+		records[i].ClockSkew = skew
+	}
+	return records, nil
+}
 
-	// Send ACK for header
-	if _, err := c.conn.Write(BuildACKResponse()); err != nil {
-		return header, nil, fmt.Errorf("failed to send header ACK: %v", err)
+// SetMaxRecords limits the number of records returned by a download, 0
+// (the default) downloads all records
+func (c *Client) SetMaxRecords(n int) {
+	c.maxRec = n
+}
+
+// SetBlockSelect sets the block select bitmask sent with download requests,
+// measures only (BlockSelMeasures) by default
+func (c *Client) SetBlockSelect(sel byte) {
+	c.blockSel = sel
+}
+
+// SetMaxRetries sets how many times in a row an invalid frame is refused with
+// a NAK before the download is aborted
+func (c *Client) SetMaxRetries(n int) {
+	c.maxRetries = n
+}
+
+// watch unblocks any pending read or write as soon as ctx is done. The
+// returned function stops watching.
+func (c *Client) watch(ctx context.Context) func() bool {
+	conn := c.conn
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+}
+
+// arm sets the connection deadline for the next operation from the frame
+// timeout and the context deadline
+func (c *Client) arm(ctx context.Context) error {
+	var deadline time.Time
+	if c.frameTimeout > 0 {
+		deadline = time.Now().Add(c.frameTimeout)
 	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
 
-	var measurements []*Measurement
-	buf := make([]byte, 1) // For reading first byte
-	pkgCounter := 0
+	// Checked after setting the deadline, so a cancellation cannot be missed
+	return ctx.Err()
+}
 
-	for {
-		// Read first byte to identify message type
-		_, err := io.ReadFull(c.conn, buf)
-		if err != nil {
-			return header, measurements, fmt.Errorf("failed to read message start: %v", err)
-		}
+// cause returns the context error when the context ended the operation
+func cause(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (c *Client) write(ctx context.Context, b []byte) error {
+	if err := c.arm(ctx); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(b)
+	if err == nil {
+		c.Stats.countFrameSent(b)
+	}
+	return cause(ctx, err)
+}
 
-		// Handle STX
-		if buf[0] != STX {
-			return header, measurements, fmt.Errorf("expected STX, got %x", buf[0])
+// readFrame reads the next frame, answering invalid frames with a NAK so the
+// server sends them again
+func (c *Client) readFrame(ctx context.Context) (*Frame, error) {
+	for retry := 0; ; retry++ {
+		if err := c.arm(ctx); err != nil {
+			return nil, err
+		}
+		frame, err := c.fr.ReadFrame()
+		c.Stats.countFrameReceived(frame, err)
+		var ferr *FrameError
+		if !errors.As(err, &ferr) {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() && ctx.Err() == nil {
+				c.Stats.Timeouts.Add(1)
+			}
+			return frame, cause(ctx, err)
+		}
+		if retry >= c.maxRetries {
+			return nil, fmt.Errorf("%v, giving up after %d retries", err, retry)
 		}
 
-		// Read next 4 bytes to identify message type
-		typeBuf := make([]byte, 4)
-		_, err = io.ReadFull(c.conn, typeBuf)
-		if err != nil {
-			return header, measurements, fmt.Errorf("failed to read message type: %v", err)
+		log.Printf("Received %v, sending NAK (retry %d/%d)", err, retry+1, c.maxRetries)
+		if err := c.write(ctx, BuildNAKResponse()); err != nil {
+			return nil, fmt.Errorf("failed to send NAK: %v", err)
 		}
+		c.Stats.NAKsSent.Add(1)
+		c.Stats.Retransmissions.Add(1)
+	}
+}
 
-		// Determine message type and length
-		var (
-			messageType string
-			totalLength int
-		)
+func (c *Client) SendDownloadRequest(isTotal bool) (*Header, []*Measurement, error) {
+	return c.DownloadContext(context.Background(), isTotal)
+}
 
-		// First, check if we have at least 4 bytes
-		if len(typeBuf) < 4 {
-			return header, measurements, fmt.Errorf("invalid message header length")
-		}
+// DownloadContext runs a DT (isTotal) or DP download and collects its
+// measurements. The context and the download timeout bound the whole
+// exchange, the frame timeout every single read and write.
+func (c *Client) DownloadContext(ctx context.Context, isTotal bool) (*Header, []*Measurement, error) {
+	var measurements []*Measurement
+	header, err := c.Download(ctx, isTotal, func(m *Measurement) error {
+		measurements = append(measurements, m)
+		return nil
+	})
+	return header, measurements, err
+}
 
-		// Check for final package first (most specific case)
-		if bytes.Equal(typeBuf, []byte{'P', 'C', 'D', '4'}) {
-			// Need to check next 3 bytes for 'EOD'
-			eodBuf := make([]byte, 3)
-			_, err = io.ReadFull(c.conn, eodBuf)
-			if err != nil {
-				return header, measurements, fmt.Errorf("failed to read EOD marker: %v", err)
-			}
+// MeasurementHandler is called with every measurement block of a download
+type MeasurementHandler func(m *Measurement) error
+
+// Download runs a DT (isTotal) or DP download and passes each measurement to
+// handle as soon as it arrives. A block is acknowledged only once handle has
+// returned without error, so the server does not send the next one before
+// that. When handle fails the download is aborted and the connection closed:
+// the server does not commit an unfinished download, so the same blocks are
+// sent again by the next one.
+func (c *Client) Download(ctx context.Context, isTotal bool, handle MeasurementHandler) (*Header, error) {
+	command := byte('P')
+	if isTotal {
+		command = 'T'
+	}
+	return c.download(ctx, command, false, handle)
+}
 
-			if bytes.Equal(eodBuf, []byte{'E', 'O', 'D'}) {
-				messageType = "final"
-				totalLength = 11 // STX + PC + D4 + EOD + checksum + ETX
-				typeBuf = append(typeBuf, eodBuf...)
-			} else {
-				// Not a final package, so it must be a measurement
-				// We've already read 4 bytes (PC D4) and 3 more (non-EOD)
-				// For measurement, we need to read the remaining 49 bytes (56 total - 7 already read)
-				messageType = "measurement"
-				totalLength = 56
-				pkgCounter++
-				log.Printf("Received measure package %d", pkgCounter)
-
-				// We have 3 bytes in eodBuf that are part of the measurement
-				remaining := totalLength - 1 - 4 - 3 // STX(1) + typeBuf(4) + eodBuf(3)
-				remainingBuf := make([]byte, remaining)
-				_, err = io.ReadFull(c.conn, remainingBuf)
-				if err != nil {
-					return header, measurements, fmt.Errorf("failed to read measurement body: %v", err)
-				}
+// Interrupted reports whether the last download did not complete, so that it
+// can be continued with Resume
+func (c *Client) Interrupted() bool {
+	return c.interrupted != 0
+}
 
-				// Combine all parts
-				fullMessage := append([]byte{STX}, typeBuf...)
-				fullMessage = append(fullMessage, eodBuf...)
-				fullMessage = append(fullMessage, remainingBuf...)
+// Resume continues the last download, which did not complete, usually after
+// reconnecting. The server sends the blocks following the last one handled;
+// a block handled but not acknowledged before the interruption is sent again
+// and skipped, so handle never sees a block twice.
+func (c *Client) Resume(ctx context.Context, handle MeasurementHandler) (*Header, error) {
+	if c.interrupted == 0 {
+		return nil, fmt.Errorf("no interrupted download to resume")
+	}
+	return c.download(ctx, c.interrupted, true, handle)
+}
 
-				// Parse the measurement
-				measurement, err := ParseMeasurement(fullMessage)
-				if err != nil {
-					return header, measurements, fmt.Errorf("failed to parse measurement: %v", err)
-				}
-				measurements = append(measurements, measurement)
+// download runs a download and counts it in Stats
+func (c *Client) download(ctx context.Context, command byte, resume bool, handle MeasurementHandler) (*Header, error) {
+	name := string([]byte{'D', command})
+	c.Stats.countRequest(name)
+	start := time.Now()
+	header, err := c.runDownload(ctx, command, resume, handle)
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	c.Stats.countDownload(name, result, time.Since(start))
+	return header, err
+}
 
-				// Send ACK for measurement
-				ack := BuildACKMeasureResponse()
-				if _, err := c.conn.Write(ack); err != nil {
-					return header, measurements, fmt.Errorf("failed to send ACK measure: %v", err)
-				}
-				log.Printf("Sent session ACK: %q", ack)
+// readHeader decodes the Header received at the given local time and
+// reports the concentrator clock skew
+func (c *Client) readHeader(header *Header, received time.Time) {
+	info, err := header.Info(c.location)
+	c.headerMu.Lock()
+	defer c.headerMu.Unlock()
+	if err != nil {
+		c.header = nil
+		log.Printf("Header not decoded: %v", err)
+		return
+	}
+	c.header = &info
+	c.skew = info.Time.Sub(received.In(c.location).Truncate(time.Minute))
+	log.Printf("Concentrator %s/%s, SW %s, clock %s (%s local time)",
+		info.UserCode, info.PlantCode, info.SWVersion, info.Time.Format("2006-01-02 15:04 MST"), formatSkew(c.skew))
+	if c.skewed(c.skew) {
+		c.Stats.ClockSkewAlerts.Add(1)
+		log.Printf("ALERT: clock of %s is %s local time, beyond the %s threshold",
+			c.ServerAddr, formatSkew(c.skew), c.skewThreshold)
+	}
+}
 
-				// Skip the rest of the loop since we already processed this as a measurement
-				continue
-			}
-		} else if bytes.Equal(typeBuf[:3], []byte{'P', 'C', 'D'}) && typeBuf[3] == '4' {
-			// Regular measurement package
-			messageType = "measurement"
-			totalLength = 56
-			pkgCounter++
-			log.Printf("Received measure package %d", pkgCounter)
-		} else {
-			return header, measurements, fmt.Errorf("unknown message type: %x", typeBuf)
-		}
+// formatSkew renders a clock skew as "1h2m0s ahead of" or "5m0s behind"
+func formatSkew(skew time.Duration) string {
+	switch {
+	case skew > 0:
+		return skew.String() + " ahead of"
+	case skew < 0:
+		return (-skew).String() + " behind"
+	}
+	return "in sync with"
+}
 
-		// Read remaining bytes
-		remaining := totalLength - 1 - len(typeBuf) // Already read STX and typeBuf
-		remainingBuf := make([]byte, remaining)
-		_, err = io.ReadFull(c.conn, remainingBuf)
+func (c *Client) runDownload(ctx context.Context, command byte, resume bool, handle MeasurementHandler) (*Header, error) {
+	if c.conn == nil {
+		return nil, fmt.Errorf("not connected to server")
+	}
+	if !resume {
+		c.lastBlock = nil
+	}
+	c.interrupted = command
+
+	if c.downloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.downloadTimeout)
+		defer cancel()
+	}
+	stop := c.watch(ctx)
+	defer stop()
+
+	request := NewRequest()
+	request.UserCode = c.userCode
+	request.PlantCode = c.plantCode
+	request.Command[1] = command
+	if resume {
+		request.Reserved |= RequestResume
+	}
+	request.BlockSel = c.blockSel
+	request.SetMaxRecords(c.maxRec)
+	request.CalculateRequestChecksum()
+
+	// Send request
+	if err := c.write(ctx, request.Bytes()); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	log.Printf("Sent %s request", string(request.Command[:]))
+
+	// Read header block
+	frame, err := c.readFrame(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header block: %w", err)
+	}
+	if frame.Type != FrameHeader {
+		return nil, fmt.Errorf("expected header block, got %s frame", frame.Type)
+	}
+	header := frame.Header
+	c.readHeader(header, time.Now())
+
+	// Send ACK for header
+	if err := c.write(ctx, BuildACKResponse()); err != nil {
+		return header, fmt.Errorf("failed to send header ACK: %w", err)
+	}
+
+	pkgCounter := 0
+
+	for {
+		frame, err := c.readFrame(ctx)
 		if err != nil {
-			return header, measurements, fmt.Errorf("failed to read message body: %v", err)
+			return header, fmt.Errorf("failed to read message: %w", err)
 		}
 
-		// Combine all parts
-		fullMessage := append([]byte{STX}, typeBuf...)
-		fullMessage = append(fullMessage, remainingBuf...)
+		switch frame.Type {
+		case FrameMeasurement:
+			pkgCounter++
+			log.Printf("Received measure package %d", pkgCounter)
+
+			if resume && pkgCounter == 1 && c.lastBlock != nil && *c.lastBlock == frame.Measurement.Data {
+				log.Printf("Skipping measure package already received before the interruption")
+			} else {
+				if err := handle(frame.Measurement); err != nil {
+					c.Close()
+					c.conn = nil
+					return header, fmt.Errorf("measure package %d not handled, download aborted: %w", pkgCounter, err)
+				}
+				data := frame.Measurement.Data
+				c.lastBlock = &data
+			}
 
-		// Parse based on type
-		switch messageType {
-		case "measurement":
-			measurement, err := ParseMeasurement(fullMessage)
-			if err != nil {
-				return header, measurements, fmt.Errorf("failed to parse measurement: %v", err)
+			// Send ACK for measurement
+			ack := BuildACKMeasureResponse()
+			if err := c.write(ctx, ack); err != nil {
+				return header, fmt.Errorf("failed to send ACK measure: %w", err)
 			}
-			measurements = append(measurements, measurement)
+			log.Printf("Sent session ACK: %q", ack)
+
+		case FrameFinal:
+			log.Printf("Received final package: %s", string(frame.Final.EndDownload[:]))
 
-		case "final":
-			final, err := ParseFinal(fullMessage)
-			if err != nil {
-				return header, measurements, fmt.Errorf("failed to parse final package: %v", err)
+			// Acknowledge the end of download so the server commits it
+			if err := c.write(ctx, BuildACKResponse()); err != nil {
+				return header, fmt.Errorf("failed to send final ACK: %w", err)
 			}
-			log.Printf("Received final package: %s", string(final.EndDownload[:]))
-			return header, measurements, nil
+			c.interrupted = 0
+			c.lastBlock = nil
+			return header, nil
+
+		case FrameNAK:
+			c.Stats.NAKsReceived.Add(1)
+			return header, fmt.Errorf("server sent NAK during download")
+
+		default:
+			return header, fmt.Errorf("unexpected %s frame during download", frame.Type)
 		}
+	}
+}
 
-		// Send ACK
-		if _, err := c.conn.Write(BuildACKResponse()); err != nil {
-			return header, measurements, fmt.Errorf("failed to send ACK: %v", err)
+// Measurements returns an iterator over the measurements of a DT (isTotal)
+// or DP download. Each block is acknowledged when the loop body asks for the
+// next one; breaking out of the loop aborts the download as a failing
+// Download handler does. A download error is yielded last, with a nil
+// measurement.
+func (c *Client) Measurements(ctx context.Context, isTotal bool) iter.Seq2[*Measurement, error] {
+	return func(yield func(*Measurement, error) bool) {
+		_, err := c.Download(ctx, isTotal, func(m *Measurement) error {
+			if !yield(m, nil) {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopIteration) {
+			yield(nil, err)
 		}
 	}
 }
 
+var errStopIteration = errors.New("iteration stopped")
+
 // Helper function to parse measurement from byte slice
 func parseMeasurement(data []byte) (*Measurement, error) {
 	// find STX pos
@@ -1,54 +1,195 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"time"
 
 	"FakeLPM/fakelpm"
+	"FakeLPM/fakelpm/storage"
 )
 
 // Client
 func main() {
+	if err := run(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+// run is the client, returning rather than exiting on errors so that the
+// database and the output are closed
+func run() error {
 	port := flag.Int("port", 5001, "Server port")
+	maxRec := flag.Int("maxrec", 0, "Maximum records per download (0 = all)")
+	blockSel := flag.Uint("blocksel", uint(fakelpm.BlockSelMeasures), "Block select bitmask")
+	retries := flag.Int("retries", fakelpm.DefaultMaxRetries, "NAKs sent for the same frame before giving up")
+	dialTimeout := flag.Duration("dial-timeout", fakelpm.DefaultDialTimeout, "Connection timeout (0 = none)")
+	frameTimeout := flag.Duration("frame-timeout", 15*time.Second, "Timeout for every read and write (0 = none)")
+	downloadTimeout := flag.Duration("download-timeout", 0, "Timeout for a whole download (0 = none)")
+	resume := flag.Int("resume", 0, "Times an interrupted download is resumed after reconnecting")
+	user := flag.String("user", "0000", "UserCode sent with requests")
+	plant := flag.String("plant", "0000", "PlantCode sent with requests")
+	targets := flag.String("targets", "", "JSON file of concentrators to poll with DP downloads, instead of a single DT and DP")
+	concurrency := flag.Int("concurrency", fakelpm.DefaultPollConcurrency, "Downloads running at once when polling")
+	out := flag.String("out", "", "File the downloaded records are written to (- = standard output)")
+	format := flag.String("format", fakelpm.SinkJSONL, "Format of the -out file: jsonl or csv")
+	metricsAddr := flag.String("metrics", "", "Address serving /metrics over HTTP, e.g. :9101 (none when empty)")
+	dbPath := flag.String("db", "", "SQLite database the downloaded records are stored in, deduplicated")
+	skewThreshold := flag.Duration("skew-threshold", fakelpm.DefaultSkewThreshold, "Concentrator clock skew, either way, beyond which an alert is logged")
+	correctSkew := flag.Bool("correct-skew", false, "Correct reading timestamps by the concentrator clock skew when it is beyond -skew-threshold")
 	flag.Parse()
 
+	var sinks fakelpm.MultiSink
+	if *dbPath != "" {
+		db, err := storage.Open(*dbPath)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %v", err)
+		}
+		defer db.Close()
+		sinks = append(sinks, db)
+	}
+	if *out != "" {
+		s, err := fakelpm.OpenSink(*format, *out)
+		if err != nil {
+			return fmt.Errorf("failed to open output: %v", err)
+		}
+		defer func() {
+			if err := s.Close(); err != nil {
+				log.Printf("Failed to close output: %v", err)
+			}
+		}()
+		sinks = append(sinks, s)
+	}
+	var sink fakelpm.Sink = fakelpm.SinkFunc(logRecords)
+	if len(sinks) > 0 {
+		sink = sinks
+	}
+
+	if *targets != "" {
+		list, err := fakelpm.LoadTargets(*targets)
+		if err != nil {
+			return fmt.Errorf("failed to load targets: %v", err)
+		}
+		poller := fakelpm.NewPoller(list, sink)
+		poller.Concurrency = *concurrency
+		serveMetrics(*metricsAddr, poller)
+		poller.Configure = func(t fakelpm.Target, c *fakelpm.Client) {
+			c.SetDialTimeout(*dialTimeout)
+			c.SetFrameTimeout(*frameTimeout)
+			c.SetDownloadTimeout(*downloadTimeout)
+			c.SetMaxRecords(*maxRec)
+			c.SetBlockSelect(byte(*blockSel))
+			c.SetMaxRetries(*retries)
+			c.SetSkewThreshold(*skewThreshold)
+			c.SetCorrectSkew(*correctSkew)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		log.Printf("Polling %d concentrators", len(list))
+		if err := poller.Run(ctx); err != nil && err != context.Canceled {
+			return fmt.Errorf("poller failed: %v", err)
+		}
+		return nil
+	}
+
 	// Setup client
 	cl := fakelpm.NewClient(fmt.Sprintf("localhost:%d", *port))
-	cl.SetTimeout(15 * time.Second) // Set reasonable timeout
+	cl.SetDialTimeout(*dialTimeout)
+	cl.SetFrameTimeout(*frameTimeout)
+	cl.SetDownloadTimeout(*downloadTimeout)
+	cl.SetMaxRecords(*maxRec)
+	cl.SetBlockSelect(byte(*blockSel))
+	cl.SetMaxRetries(*retries)
+	cl.SetSkewThreshold(*skewThreshold)
+	cl.SetCorrectSkew(*correctSkew)
+	if err := cl.SetUserCode(*user); err != nil {
+		return err
+	}
+	if err := cl.SetPlantCode(*plant); err != nil {
+		return err
+	}
+
+	serveMetrics(*metricsAddr, cl)
 
 	if err := cl.Connect(); err != nil {
-		log.Fatalf("Client failed to connect: %v", err)
+		return fmt.Errorf("client failed to connect: %v", err)
 	}
 	defer cl.Close()
 
 	// Send DT request (total download)
 	log.Println("Sending DT request...")
-	_, _, err := cl.SendDownloadRequest(true)
-	if err != nil {
-		log.Fatalf("DT request failed: %v", err)
+	if err := download(cl, sink, true, *resume); err != nil {
+		return fmt.Errorf("DT request failed: %v", err)
 	}
-	// Print received packages
-	// log.Printf("Received header block:\n%+v", header)
-	// log.Printf("Received %d measurements:", len(measurements))
-	// for i, m := range measurements {
-	// 	log.Printf("Measurement %d: %+v", i+1, m)
-	// }
 
 	// Wait a moment before next request
 	time.Sleep(1 * time.Second)
 
 	// Send DP request (partial download)
 	log.Println("Sending DP request...")
-	_, _, err = cl.SendDownloadRequest(false)
+	if err := download(cl, sink, false, *resume); err != nil {
+		return fmt.Errorf("DP request failed: %v", err)
+	}
+	return nil
+}
+
+// download runs a DT (isTotal) or DP download into sink, reconnecting and
+// resuming it up to resume times when it is interrupted
+func download(cl *fakelpm.Client, sink fakelpm.Sink, isTotal bool, resume int) error {
+	ctx := context.Background()
+	received := 0
+	handle := func(m *fakelpm.Measurement) error {
+		received++
+		records, err := cl.Records(cl.ServerAddr, m)
+		if err != nil {
+			log.Printf("Skipping undecodable block: %v", err)
+			return nil
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		return sink.Write(ctx, records)
+	}
+
+	_, err := cl.Download(ctx, isTotal, handle)
+	for attempt := 1; err != nil && cl.Interrupted() && attempt <= resume; attempt++ {
+		log.Printf("Download interrupted after %d measurements: %v", received, err)
+		log.Printf("Reconnecting to resume (attempt %d/%d)", attempt, resume)
+		cl.Close()
+		if err = cl.Connect(); err != nil {
+			continue
+		}
+		_, err = cl.Resume(ctx, handle)
+	}
 	if err != nil {
-		log.Fatalf("DP request failed: %v", err)
-	}
-	// Print received packages
-	// log.Printf("Received header block:\n%+v", header)
-	// log.Printf("Received %d measurements:", len(measurements))
-	// for i, m := range measurements {
-	// 	log.Printf("Measurement %d: %+v", i+1, m)
-	// }
+		return err
+	}
+	log.Printf("Download complete, %d measurements received", received)
+	return nil
+}
+
+func logRecords(ctx context.Context, records []fakelpm.Record) error {
+	for _, r := range records {
+		log.Printf("%s lamp %d at %s: %s %.0fV %.2fA", r.Target, r.Address,
+			r.Timestamp.Format(time.RFC3339), r.Flags, r.Voltage, r.Current)
+	}
+	return nil
+}
+
+// serveMetrics serves the metrics of collectors on addr in the background,
+// when addr is set
+func serveMetrics(addr string, collectors ...fakelpm.MetricsCollector) {
+	if addr == "" {
+		return
+	}
+	log.Printf("Metrics served on http://%s/metrics", addr)
+	go func() {
+		log.Fatalf("Metrics server failed: %v", fakelpm.ServeMetrics(addr, collectors...))
+	}()
 }
@@ -0,0 +1,53 @@
+package fakelpm
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientBlockSelect(t *testing.T) {
+	server, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	tests := []struct {
+		name     string
+		set      bool
+		sel      byte
+		measures bool
+	}{
+		{"default", false, 0, true},
+		{"measures", true, BlockSelMeasures, true},
+		{"nothing", true, 0x00, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(ln.Addr().String())
+			c.SetTimeout(2 * time.Second)
+			if tt.set {
+				c.SetBlockSelect(tt.sel)
+			}
+			if err := c.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			_, measurements, err := c.SendDownloadRequest(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(measurements) > 0; got != tt.measures {
+				t.Errorf("got %d measurements", len(measurements))
+			}
+		})
+	}
+}
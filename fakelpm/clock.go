@@ -0,0 +1,126 @@
+package fakelpm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clock is the time of a Server: the date and time of the Header, the dates
+// of the measurements and the plant simulation all follow it
+type Clock interface {
+	Now() time.Time
+}
+
+// SteppedClock is a Clock that can be moved forward, by Server.Step and by
+// the admin API
+type SteppedClock interface {
+	Clock
+	Advance(d time.Duration)
+}
+
+// Clock kinds accepted by NewClock
+const (
+	ClockReal        = "real"        // the wall clock
+	ClockFixed       = "fixed"       // stopped at the start time for good
+	ClockManual      = "manual"      // stopped at the start time, moved by Advance only
+	ClockAccelerated = "accelerated" // speed times faster than the wall clock
+)
+
+// NewClock returns a clock of the given kind starting at start. speed is used
+// by the accelerated clock only.
+func NewClock(kind string, start time.Time, speed float64) (Clock, error) {
+	switch kind {
+	case ClockReal:
+		return RealClock{}, nil
+	case ClockFixed:
+		return NewFixedClock(start), nil
+	case ClockManual:
+		return NewManualClock(start), nil
+	case ClockAccelerated:
+		return NewSimClock(start, speed), nil
+	}
+	return nil, fmt.Errorf("unknown clock %q (want %s, %s, %s or %s)", kind, ClockReal, ClockFixed, ClockManual, ClockAccelerated)
+}
+
+// RealClock is the wall clock
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// FixedClock always returns the same time
+type FixedClock struct {
+	t time.Time
+}
+
+func NewFixedClock(t time.Time) FixedClock {
+	return FixedClock{t: t}
+}
+
+func (c FixedClock) Now() time.Time {
+	return c.t
+}
+
+// ManualClock only moves when it is advanced or set
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t, backwards too
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// SimClock is the accelerated clock: it runs speed times faster than the
+// wall clock and can be moved forward with Advance; a speed of 0
+// stops it, so that it only moves with Advance.
+type SimClock struct {
+	mu     sync.Mutex
+	origin time.Time // wall time the clock was started at
+	start  time.Time // simulated time at origin
+	speed  float64
+	offset time.Duration
+}
+
+func NewSimClock(start time.Time, speed float64) *SimClock {
+	if speed < 0 {
+		speed = 1
+	}
+	return &SimClock{origin: time.Now(), start: start, speed: speed}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elapsed := time.Duration(float64(time.Since(c.origin)) * c.speed)
+	return c.start.Add(elapsed + c.offset)
+}
+
+// Advance moves the simulated time forward by d
+func (c *SimClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offset += d
+}
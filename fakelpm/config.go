@@ -0,0 +1,232 @@
+package fakelpm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config describes the concentrators emulated by one process, as read from
+// the JSON file given to fakelpm/server. Every listener is a Server; a
+// listener with a single plant answers any PlantCode, one with several
+// plants routes requests by PlantCode. All servers share the same simulated
+// clock.
+type Config struct {
+	// Seed enables the seeded mode: every random choice is drawn from it
+	// and the simulated clock is stopped at Start
+	Seed *int64 `json:"seed,omitempty"`
+	// Clock is the kind of simulated clock (see NewClock): "manual" in
+	// seeded mode and "accelerated" otherwise when empty
+	Clock string   `json:"clock,omitempty"`
+	Start string   `json:"start,omitempty"` // 2006-01-02T15:04:05 local time, now when empty outside seeded mode
+	Speed float64  `json:"speed,omitempty"` // simulated clock speed, 1 when 0
+	Step  Duration `json:"step,omitempty"`
+	// History is the days of history simulated at startup, for the plants
+	// not setting their own
+	History int `json:"history,omitempty"`
+
+	Listeners []ListenerConfig `json:"listeners"`
+}
+
+// ListenerConfig is a listen address and the plants answering on it
+type ListenerConfig struct {
+	Addr    string        `json:"addr"`
+	Retries *int          `json:"retries,omitempty"`
+	Faults  []Fault       `json:"faults,omitempty"`
+	Plants  []PlantConfig `json:"plants"`
+
+	// Credentials restricts downloads to these UserCode/PlantCode pairs,
+	// requests with other codes are refused as Reject says
+	Credentials []Credential `json:"credentials,omitempty"`
+	Reject      string       `json:"reject,omitempty"` // "nak" (default) or "close"
+
+	// Replay is a capture file played back in place of the plants
+	Replay string `json:"replay,omitempty"`
+	// Admin is the listen address of the admin HTTP API of the listener
+	Admin string `json:"admin,omitempty"`
+}
+
+// PlantConfig is an emulated concentrator and its poles
+type PlantConfig struct {
+	Code     string `json:"code"`
+	Poles    int    `json:"poles,omitempty"`    // DefaultPoles when 0
+	Location string `json:"location,omitempty"` // IANA time zone, the local one when empty
+	Version  string `json:"version,omitempty"`  // SW version as 4 dot separated bytes, e.g. "1.2.3.4"
+	History  int    `json:"history,omitempty"`
+}
+
+// LoadConfig reads a JSON server configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	if len(config.Listeners) == 0 {
+		return nil, fmt.Errorf("config %s has no listeners", path)
+	}
+	for i, l := range config.Listeners {
+		for j, f := range l.Faults {
+			if err := f.Validate(); err != nil {
+				return nil, fmt.Errorf("listener %d, fault %d: %v", i, j, err)
+			}
+		}
+	}
+	return &config, nil
+}
+
+// ParseSWVersion parses a SW version written as 4 dot separated bytes
+func ParseSWVersion(s string) ([4]byte, error) {
+	var v [4]byte
+	parts := strings.Split(s, ".")
+	if len(parts) != len(v) {
+		return v, fmt.Errorf("invalid SW version %q, expected 4 dot separated numbers", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return v, fmt.Errorf("invalid SW version %q: %v", s, err)
+		}
+		v[i] = byte(n)
+	}
+	return v, nil
+}
+
+// Servers builds a Server for every listener of the configuration
+func (c *Config) Servers() ([]*Server, error) {
+	loc, err := detectTimezone()
+	if err != nil {
+		return nil, fmt.Errorf("timezone detection failed: %v", err)
+	}
+
+	startTime := time.Now().In(loc)
+	if c.Seed != nil || c.Start != "" {
+		start := c.Start
+		if start == "" {
+			start = "2024-01-01T00:00:00"
+		}
+		startTime, err = time.ParseInLocation("2006-01-02T15:04:05", start, loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start time: %v", err)
+		}
+	}
+
+	var rng *rand.Rand
+	kind := c.Clock
+	if c.Seed != nil {
+		rng = rand.New(rand.NewSource(*c.Seed))
+		if kind == "" {
+			kind = ClockManual
+		}
+	} else {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+		if kind == "" {
+			kind = ClockAccelerated
+		}
+	}
+	speed := c.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	clock, err := NewClock(kind, startTime, speed)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make([]*Server, 0, len(c.Listeners))
+	for i, l := range c.Listeners {
+		if len(l.Plants) == 0 && l.Replay == "" {
+			return nil, fmt.Errorf("listener %d (%s) has no plants", i, l.Addr)
+		}
+
+		server, err := New(l.Addr)
+		if err != nil {
+			return nil, err
+		}
+		server.Clock = clock
+		server.Rand = rand.New(rand.NewSource(rng.Int63()))
+		server.Step = time.Duration(c.Step)
+		if l.Retries != nil {
+			server.MaxRetries = *l.Retries
+		}
+		server.Faults = NewFaultInjector(l.Faults, rand.New(rand.NewSource(server.Rand.Int63())))
+		if err := server.SetCredentials(l.Credentials); err != nil {
+			return nil, fmt.Errorf("listener %d (%s): %v", i, l.Addr, err)
+		}
+		if server.Reject, err = ParseRejectAction(l.Reject); err != nil {
+			return nil, fmt.Errorf("listener %d (%s): %v", i, l.Addr, err)
+		}
+		server.Admin = l.Admin
+
+		if l.Replay != "" {
+			if server.Replay, err = LoadCapture(l.Replay); err != nil {
+				return nil, fmt.Errorf("listener %d (%s): %v", i, l.Addr, err)
+			}
+			log.Printf("Listener %s replays %s", l.Addr, l.Replay)
+		}
+
+		server.Plant = nil
+		for _, pc := range l.Plants {
+			plant, err := c.plant(pc, server, loc)
+			if err != nil {
+				return nil, fmt.Errorf("listener %d (%s): %v", i, l.Addr, err)
+			}
+			if _, ok := server.Plants[plant.Code]; ok {
+				return nil, fmt.Errorf("listener %d (%s): duplicate plant %s", i, l.Addr, plant.Code)
+			}
+			server.AddPlant(plant)
+			log.Printf("Plant %s on %s: %d poles, %s, SW version %v",
+				plant.Code, l.Addr, len(plant.Poles()), plant.Location, plant.SWVersion)
+		}
+		if len(l.Plants) == 1 {
+			for _, p := range server.Plants {
+				server.Plant = p
+			}
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+func (c *Config) plant(pc PlantConfig, server *Server, defaultLoc *time.Location) (*Plant, error) {
+	code, err := ParseCode(pc.Code)
+	if err != nil {
+		return nil, fmt.Errorf("invalid plant code: %v", err)
+	}
+
+	loc := defaultLoc
+	if pc.Location != "" {
+		if loc, err = time.LoadLocation(pc.Location); err != nil {
+			return nil, fmt.Errorf("plant %s: %v", pc.Code, err)
+		}
+	}
+	poles := pc.Poles
+	if poles == 0 {
+		poles = DefaultPoles
+	}
+	history := pc.History
+	if history == 0 {
+		history = c.History
+	}
+	if history == 0 {
+		history = DefaultHistoryDays
+	}
+
+	start := server.Clock.Now().In(loc).AddDate(0, 0, -history)
+	plant := NewPlant(string(code[:]), poles, start, rand.New(rand.NewSource(server.Rand.Int63())))
+	if pc.Version != "" {
+		if plant.SWVersion, err = ParseSWVersion(pc.Version); err != nil {
+			return nil, fmt.Errorf("plant %s: %v", pc.Code, err)
+		}
+	}
+	return plant, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+
+	"FakeLPM/fakelpm/conformance"
+)
+
+// Conformance checker: runs the protocol scenarios against a concentrator
+// and reports pass/fail for each of them
+func main() {
+	addr := flag.String("addr", "localhost:5001", "Address of the concentrator under test")
+	user := flag.String("user", "0000", "UserCode sent with requests")
+	plant := flag.String("plant", "0000", "PlantCode sent with requests")
+	timeout := flag.Duration("timeout", conformance.DefaultTimeout, "Wait for every expected frame")
+	ackTimeout := flag.Duration("ack-timeout", conformance.DefaultAckTimeout, "Wait for the target to give up on an unacknowledged frame")
+	run := flag.String("run", "", "Run only the scenarios matching this regular expression")
+	list := flag.Bool("list", false, "List the scenarios and exit")
+	verbose := flag.Bool("v", false, "Log every frame exchanged")
+	flag.Parse()
+
+	if *list {
+		for _, sc := range conformance.Scenarios() {
+			fmt.Printf("%-16s %s\n", sc.Name, sc.Description)
+		}
+		return
+	}
+
+	var filter *regexp.Regexp
+	if *run != "" {
+		var err error
+		if filter, err = regexp.Compile(*run); err != nil {
+			log.Fatalf("Invalid -run pattern: %v", err)
+		}
+	}
+
+	config := conformance.Config{
+		Addr:       *addr,
+		UserCode:   *user,
+		PlantCode:  *plant,
+		Timeout:    *timeout,
+		AckTimeout: *ackTimeout,
+	}
+	if *verbose {
+		config.Logf = log.Printf
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	results, err := conformance.Check(ctx, config, filter)
+	failed := 0
+	for _, r := range results {
+		fmt.Println(r)
+		if !r.Passed() {
+			failed++
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d/%d scenarios passed\n", len(results)-failed, len(results))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,308 @@
+// Package conformance drives an LPM concentrator endpoint through scripted
+// protocol scenarios and reports which of them it passes. The frame builders
+// and parsers of package fakelpm are the reference for what is valid.
+//
+// Use Check from a program, or Run from a Go test:
+//
+//	func TestConcentrator(t *testing.T) {
+//		conformance.Run(t, conformance.Config{Addr: "10.0.0.5:5001"})
+//	}
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"FakeLPM/fakelpm"
+)
+
+// Defaults for a Config
+const (
+	DefaultTimeout    = 5 * time.Second
+	DefaultAckTimeout = 15 * time.Second
+)
+
+// Config describes the endpoint under test
+type Config struct {
+	Addr      string
+	UserCode  string // "0000" when empty
+	PlantCode string // "0000" when empty
+
+	// Timeout bounds the wait for every frame expected from the target
+	Timeout time.Duration
+	// AckTimeout bounds the wait for the target to give up on a frame the
+	// harness does not acknowledge
+	AckTimeout time.Duration
+
+	// Logf, when set, receives a trace of every scenario
+	Logf func(format string, args ...interface{})
+}
+
+func (c Config) withDefaults() Config {
+	if c.UserCode == "" {
+		c.UserCode = "0000"
+	}
+	if c.PlantCode == "" {
+		c.PlantCode = "0000"
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.AckTimeout <= 0 {
+		c.AckTimeout = DefaultAckTimeout
+	}
+	return c
+}
+
+// Scenario is a scripted exchange with the target, Run returns why the
+// target failed it
+type Scenario struct {
+	Name        string
+	Description string
+	Run         func(ctx context.Context, s *Suite) error
+	// UserCode replaces the UserCode of the Config, when set
+	UserCode string
+}
+
+// Result is the outcome of a Scenario
+type Result struct {
+	Scenario string
+	Err      error
+	Duration time.Duration
+}
+
+func (r Result) Passed() bool {
+	return r.Err == nil
+}
+
+func (r Result) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("FAIL %s (%s): %v", r.Scenario, r.Duration.Round(time.Millisecond), r.Err)
+	}
+	return fmt.Sprintf("PASS %s (%s)", r.Scenario, r.Duration.Round(time.Millisecond))
+}
+
+// Suite is the state shared by the scenarios run against a target
+type Suite struct {
+	Config
+	user, plant [4]byte
+}
+
+// NewSuite validates the configuration of a target
+func NewSuite(config Config) (*Suite, error) {
+	config = config.withDefaults()
+	if config.Addr == "" {
+		return nil, errors.New("missing target address")
+	}
+	s := &Suite{Config: config}
+	var err error
+	if s.user, err = fakelpm.ParseCode(config.UserCode); err != nil {
+		return nil, fmt.Errorf("invalid user code: %v", err)
+	}
+	if s.plant, err = fakelpm.ParseCode(config.PlantCode); err != nil {
+		return nil, fmt.Errorf("invalid plant code: %v", err)
+	}
+	return s, nil
+}
+
+func (s *Suite) logf(format string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+// Check runs the scenarios whose name matches filter (all when nil) in order
+func Check(ctx context.Context, config Config, filter *regexp.Regexp) ([]Result, error) {
+	suite, err := NewSuite(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	for _, sc := range Scenarios() {
+		if filter != nil && !filter.MatchString(sc.Name) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+		results = append(results, suite.Run(ctx, sc))
+	}
+	return results, nil
+}
+
+// Run runs every scenario as a subtest of t
+func Run(t *testing.T, config Config) {
+	if config.Logf == nil {
+		config.Logf = t.Logf
+	}
+	suite, err := NewSuite(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sc := range Scenarios() {
+		t.Run(sc.Name, func(t *testing.T) {
+			suite := *suite
+			suite.Logf = t.Logf
+			if r := suite.Run(context.Background(), sc); r.Err != nil {
+				t.Fatal(r.Err)
+			}
+		})
+	}
+}
+
+// Run runs a single scenario
+func (s *Suite) Run(ctx context.Context, sc Scenario) Result {
+	s.logf("=== %s: %s", sc.Name, sc.Description)
+	start := time.Now()
+	if sc.UserCode != "" {
+		suite := *s
+		user, err := fakelpm.ParseCode(sc.UserCode)
+		if err != nil {
+			return Result{Scenario: sc.Name, Err: fmt.Errorf("invalid user code: %v", err)}
+		}
+		suite.user = user
+		s = &suite
+	}
+	err := sc.Run(ctx, s)
+	return Result{Scenario: sc.Name, Err: err, Duration: time.Since(start)}
+}
+
+// session is a connection to the target
+type session struct {
+	suite *Suite
+	conn  net.Conn
+	fr    *fakelpm.FrameReader
+	stop  func() bool
+}
+
+// dial connects to the target, the welcome ACK is left unread
+func (s *Suite) dial(ctx context.Context) (*session, error) {
+	dialer := net.Dialer{Timeout: s.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("connection failed: %v", err)
+	}
+	return &session{
+		suite: s,
+		conn:  conn,
+		fr:    fakelpm.NewFrameReader(conn),
+		stop:  context.AfterFunc(ctx, func() { conn.Close() }),
+	}, nil
+}
+
+// connect connects to the target and checks its welcome ACK
+func (s *Suite) connect(ctx context.Context) (*session, error) {
+	ss, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ss.expect("welcome ACK", fakelpm.FrameACK); err != nil {
+		ss.close()
+		return nil, err
+	}
+	return ss, nil
+}
+
+func (ss *session) close() {
+	ss.stop()
+	ss.conn.Close()
+}
+
+// read returns the next frame, waiting at most timeout for it
+func (ss *session) read(timeout time.Duration) (*fakelpm.Frame, error) {
+	ss.conn.SetReadDeadline(time.Now().Add(timeout))
+	frame, err := ss.fr.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	ss.suite.logf("<- %s %X", frame.Type, frame.Raw)
+	return frame, nil
+}
+
+func (ss *session) write(name string, b []byte) error {
+	ss.suite.logf("-> %s %X", name, b)
+	ss.conn.SetWriteDeadline(time.Now().Add(ss.suite.Timeout))
+	if _, err := ss.conn.Write(b); err != nil {
+		return fmt.Errorf("failed to send %s: %v", name, err)
+	}
+	return nil
+}
+
+// expect reads the next frame and checks it is of one of the given types
+func (ss *session) expect(what string, types ...fakelpm.FrameType) (*fakelpm.Frame, error) {
+	frame, err := ss.read(ss.suite.Timeout)
+	if err != nil {
+		var ferr *fakelpm.FrameError
+		var nerr net.Error
+		switch {
+		case errors.As(err, &ferr):
+			return nil, fmt.Errorf("expected %s, got %v (%X)", what, ferr, ferr.Raw)
+		case errors.As(err, &nerr) && nerr.Timeout():
+			return nil, fmt.Errorf("expected %s, got nothing within %s", what, ss.suite.Timeout)
+		}
+		return nil, fmt.Errorf("expected %s: %v", what, err)
+	}
+	for _, t := range types {
+		if frame.Type == t {
+			return frame, nil
+		}
+	}
+	return nil, fmt.Errorf("expected %s, got %s frame %X", what, frame.Type, frame.Raw)
+}
+
+// request builds a request of the suite codes for command
+func (s *Suite) request(command string) []byte {
+	req := fakelpm.NewRequest()
+	req.UserCode = s.user
+	req.PlantCode = s.plant
+	copy(req.Command[:], command)
+	req.CalculateRequestChecksum()
+	return req.Bytes()
+}
+
+// download runs a complete DT or DP download, checking every frame, and
+// returns the Data blocks received
+func (ss *session) download(command string) ([][48]byte, error) {
+	if err := ss.write(command+" request", ss.suite.request(command)); err != nil {
+		return nil, err
+	}
+
+	frame, err := ss.expect("Header", fakelpm.FrameHeader)
+	if err != nil {
+		return nil, err
+	}
+	h := frame.Header
+	if h.UserCode != ss.suite.user || h.PlantCode != ss.suite.plant {
+		return nil, fmt.Errorf("Header codes %q/%q do not match the request %q/%q",
+			h.UserCode[:], h.PlantCode[:], ss.suite.user[:], ss.suite.plant[:])
+	}
+	if err := ss.write("ACK", fakelpm.BuildACKResponse()); err != nil {
+		return nil, err
+	}
+
+	var blocks [][48]byte
+	for {
+		frame, err := ss.expect("Measurement or Final", fakelpm.FrameMeasurement, fakelpm.FrameFinal)
+		if err != nil {
+			return blocks, fmt.Errorf("after %d measurements: %v", len(blocks), err)
+		}
+		if frame.Type == fakelpm.FrameFinal {
+			return blocks, ss.write("ACK", fakelpm.BuildACKResponse())
+		}
+
+		data := frame.Measurement.Data
+		if _, err := fakelpm.DecodeLampBlock(data[:], time.UTC); err != nil {
+			return blocks, fmt.Errorf("measurement %d has an undecodable Data block: %v", len(blocks)+1, err)
+		}
+		blocks = append(blocks, data)
+		if err := ss.write("MSR", fakelpm.BuildACKMeasureResponse()); err != nil {
+			return blocks, err
+		}
+	}
+}
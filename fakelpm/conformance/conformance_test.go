@@ -0,0 +1,32 @@
+package conformance
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"FakeLPM/fakelpm"
+)
+
+// TestServer runs the suite against the emulated concentrator
+func TestServer(t *testing.T) {
+	server, err := fakelpm.New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AckTimeout = 200 * time.Millisecond
+	server.MaxRetries = 1
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	Run(t, Config{
+		Addr:       ln.Addr().String(),
+		Timeout:    2 * time.Second,
+		AckTimeout: 2 * time.Second,
+	})
+}
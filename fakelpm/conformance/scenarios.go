@@ -0,0 +1,212 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"FakeLPM/fakelpm"
+)
+
+// Scenarios returns the conformance scenarios in the order they are run. The
+// DP scenarios download with their own UserCode, so that they start from a
+// cursor no other scenario has moved; the target must accept those codes.
+func Scenarios() []Scenario {
+	return []Scenario{
+		{Name: "welcome-ack", Description: "the target greets every new connection with an ACK", Run: welcomeACK},
+		{Name: "dt", Description: "a DT request gets a Header, valid measurements and a Final", Run: totalDownload},
+		{Name: "dp", Description: "a completed DP is committed, the next DP repeats none of its blocks", Run: partialDownload, UserCode: "0901"},
+		{Name: "bad-checksum", Description: "a request with a bad checksum is refused with a NAK, the connection stays usable", Run: badChecksum},
+		{Name: "unknown-command", Description: "a request with an unknown command is refused with a NAK", Run: unknownCommand},
+		{Name: "premature-close", Description: "a client closing in the middle of a DP does not commit it nor upset the target", Run: prematureClose, UserCode: "0902"},
+		{Name: "ack-timeout", Description: "a frame left unacknowledged is resent or the connection closed, never followed by the next one", Run: ackTimeout},
+	}
+}
+
+func welcomeACK(ctx context.Context, s *Suite) error {
+	ss, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	ss.close()
+	return nil
+}
+
+func totalDownload(ctx context.Context, s *Suite) error {
+	ss, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer ss.close()
+
+	blocks, err := ss.download("DT")
+	if err != nil {
+		return err
+	}
+	s.logf("DT returned %d measurements", len(blocks))
+	return nil
+}
+
+func partialDownload(ctx context.Context, s *Suite) error {
+	ss, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer ss.close()
+
+	first, err := ss.download("DP")
+	if err != nil {
+		return fmt.Errorf("first DP: %v", err)
+	}
+	if len(first) == 0 {
+		return fmt.Errorf("first DP of user %s returned no measurement, nothing to check the cursor with", s.user[:])
+	}
+	second, err := ss.download("DP")
+	if err != nil {
+		return fmt.Errorf("second DP: %v", err)
+	}
+	s.logf("DPs returned %d and %d measurements", len(first), len(second))
+
+	seen := make(map[[48]byte]bool, len(first))
+	for _, b := range first {
+		seen[b] = true
+	}
+	for i, b := range second {
+		if seen[b] {
+			return fmt.Errorf("measurement %d of the second DP was already sent by the first: %X", i+1, b)
+		}
+	}
+	return nil
+}
+
+func badChecksum(ctx context.Context, s *Suite) error {
+	ss, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer ss.close()
+
+	req := s.request("DT")
+	req[fakelpm.RequestLen-3] ^= 0xFF
+	if err := ss.write("DT request with bad checksum", req); err != nil {
+		return err
+	}
+	if _, err := ss.expect("NAK", fakelpm.FrameNAK); err != nil {
+		return err
+	}
+
+	if _, err := ss.download("DT"); err != nil {
+		return fmt.Errorf("valid request after the NAK: %v", err)
+	}
+	return nil
+}
+
+func unknownCommand(ctx context.Context, s *Suite) error {
+	ss, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer ss.close()
+
+	if err := ss.write("DX request", s.request("DX")); err != nil {
+		return err
+	}
+	_, err = ss.expect("NAK", fakelpm.FrameNAK)
+	return err
+}
+
+func prematureClose(ctx context.Context, s *Suite) error {
+	ss, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if err := ss.write("DP request", s.request("DP")); err != nil {
+		ss.close()
+		return err
+	}
+	if _, err := ss.expect("Header", fakelpm.FrameHeader); err != nil {
+		ss.close()
+		return err
+	}
+	if err := ss.write("ACK", fakelpm.BuildACKResponse()); err != nil {
+		ss.close()
+		return err
+	}
+	frame, err := ss.expect("Measurement or Final", fakelpm.FrameMeasurement, fakelpm.FrameFinal)
+	ss.close()
+	if err != nil {
+		return err
+	}
+	s.logf("Connection closed after the first %s frame", frame.Type)
+
+	ss, err = s.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("reconnecting: %v", err)
+	}
+	defer ss.close()
+	blocks, err := ss.download("DP")
+	if err != nil {
+		return fmt.Errorf("DP after reconnecting: %v", err)
+	}
+
+	if frame.Type == fakelpm.FrameFinal {
+		return fmt.Errorf("DP of user %s returned no measurement, nothing to interrupt", s.user[:])
+	}
+	for _, b := range blocks {
+		if b == frame.Measurement.Data {
+			return nil
+		}
+	}
+	return fmt.Errorf("measurement not acknowledged before the close was not sent again: %X", frame.Measurement.Data)
+}
+
+func ackTimeout(ctx context.Context, s *Suite) error {
+	ss, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer ss.close()
+
+	if err := ss.write("DT request", s.request("DT")); err != nil {
+		return err
+	}
+	header, err := ss.expect("Header", fakelpm.FrameHeader)
+	if err != nil {
+		return err
+	}
+
+	// Leave the Header unacknowledged
+	wait := s.AckTimeout + s.Timeout
+	start := time.Now()
+	frame, err := ss.read(wait)
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	var nerr net.Error
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed):
+		s.logf("Target closed the connection after %s", elapsed)
+		return nil
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return fmt.Errorf("target still waiting for the Header ACK after %s", wait)
+	case err != nil:
+		// A reset is as good as a close
+		s.logf("Connection ended after %s: %v", elapsed, err)
+		return nil
+	}
+
+	switch frame.Type {
+	case fakelpm.FrameHeader:
+		if string(frame.Raw) != string(header.Raw) {
+			return fmt.Errorf("resent Header differs from the first one: %X", frame.Raw)
+		}
+		s.logf("Target resent the Header after %s", elapsed)
+		return nil
+	case fakelpm.FrameNAK:
+		s.logf("Target gave up with a NAK after %s", elapsed)
+		return nil
+	}
+	return fmt.Errorf("target sent a %s frame after %s although the Header was not acknowledged", frame.Type, elapsed)
+}
@@ -0,0 +1,332 @@
+package fakelpm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultKind is a way of misbehaving on the server transport
+type FaultKind string
+
+const (
+	FaultDrop            FaultKind = "drop"             // frame is not sent
+	FaultCorruptChecksum FaultKind = "corrupt-checksum" // checksum bytes are altered
+	FaultFlipMarkers     FaultKind = "flip-markers"     // STX and ETB/ETX are swapped for wrong values
+	FaultSplit           FaultKind = "split"            // frame is sent in Chunk byte writes, Delay apart
+	FaultDelay           FaultKind = "delay"            // frame is sent after Delay
+	FaultStall           FaultKind = "stall"            // nothing is sent for Delay, forever when 0
+	FaultNAK             FaultKind = "nak"              // a NAK is sent in place of the frame
+	FaultClose           FaultKind = "close"            // connection is closed in place of the frame
+)
+
+// Duration is a time.Duration read from JSON as a string such as "1.5s"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Fault is a fault injection rule. It applies to the frames of the listed
+// types (any type when empty) written after the first After of them, with
+// the given Probability (always when 0), at most Count times per connection
+// (no limit when 0).
+type Fault struct {
+	Kind        FaultKind `json:"kind"`
+	Frames      []string  `json:"frames,omitempty"`
+	After       int       `json:"after,omitempty"`
+	Probability float64   `json:"probability,omitempty"`
+	Count       int       `json:"count,omitempty"`
+	Delay       Duration  `json:"delay,omitempty"`
+	Chunk       int       `json:"chunk,omitempty"`
+}
+
+// FaultScenario is the content of a fault scenario file
+type FaultScenario struct {
+	Faults []Fault `json:"faults"`
+}
+
+func (f Fault) Validate() error {
+	switch f.Kind {
+	case FaultDrop, FaultCorruptChecksum, FaultFlipMarkers, FaultSplit,
+		FaultDelay, FaultStall, FaultNAK, FaultClose:
+	default:
+		return fmt.Errorf("unknown fault kind %q", f.Kind)
+	}
+	for _, name := range f.Frames {
+		if _, err := ParseFrameType(name); err != nil {
+			return err
+		}
+	}
+	if f.Probability < 0 || f.Probability > 1 {
+		return fmt.Errorf("probability %v out of range", f.Probability)
+	}
+	return nil
+}
+
+func (f Fault) String() string {
+	s := string(f.Kind)
+	if len(f.Frames) > 0 {
+		s += " on " + strings.Join(f.Frames, "/")
+	}
+	if f.After > 0 {
+		s += fmt.Sprintf(" after %d", f.After)
+	}
+	return s
+}
+
+func (f Fault) targets(t FrameType) bool {
+	if len(f.Frames) == 0 {
+		return true
+	}
+	for _, name := range f.Frames {
+		if ft, _ := ParseFrameType(name); ft == t {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFault parses the command line form of a fault:
+// kind[,frames=Header/Measurement][,after=N][,prob=P][,count=N][,delay=D][,chunk=N]
+func ParseFault(spec string) (Fault, error) {
+	parts := strings.Split(spec, ",")
+	f := Fault{Kind: FaultKind(strings.TrimSpace(parts[0]))}
+
+	for _, part := range parts[1:] {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return f, fmt.Errorf("invalid fault option %q", part)
+		}
+		var err error
+		switch strings.TrimSpace(key) {
+		case "frames":
+			f.Frames = strings.Split(value, "/")
+		case "after":
+			f.After, err = strconv.Atoi(value)
+		case "prob":
+			f.Probability, err = strconv.ParseFloat(value, 64)
+		case "count":
+			f.Count, err = strconv.Atoi(value)
+		case "delay":
+			var d time.Duration
+			d, err = time.ParseDuration(value)
+			f.Delay = Duration(d)
+		case "chunk":
+			f.Chunk, err = strconv.Atoi(value)
+		default:
+			return f, fmt.Errorf("unknown fault option %q", key)
+		}
+		if err != nil {
+			return f, fmt.Errorf("invalid fault option %q: %v", part, err)
+		}
+	}
+
+	return f, f.Validate()
+}
+
+// LoadFaultScenario reads a JSON fault scenario file
+func LoadFaultScenario(path string) (*FaultScenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var scenario FaultScenario
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("invalid fault scenario %s: %v", path, err)
+	}
+	for i, f := range scenario.Faults {
+		if err := f.Validate(); err != nil {
+			return nil, fmt.Errorf("fault %d: %v", i, err)
+		}
+	}
+	return &scenario, nil
+}
+
+// FaultInjector holds the fault rules shared by the connections of a server.
+// Rules can be replaced at any time, connections pick them up on their next
+// write.
+type FaultInjector struct {
+	mu     sync.Mutex
+	faults []Fault
+	gen    int // incremented every time the rules are replaced
+	rng    *rand.Rand
+}
+
+func NewFaultInjector(faults []Fault, rng *rand.Rand) *FaultInjector {
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &FaultInjector{faults: faults, rng: rng}
+}
+
+func (fi *FaultInjector) Faults() []Fault {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return append([]Fault(nil), fi.faults...)
+}
+
+func (fi *FaultInjector) SetFaults(faults []Fault) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.faults = faults
+	fi.gen++
+}
+
+// rules returns the current rules and their generation
+func (fi *FaultInjector) rules() ([]Fault, int) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return append([]Fault(nil), fi.faults...), fi.gen
+}
+
+func (fi *FaultInjector) chance(p float64) bool {
+	if p == 0 || p >= 1 {
+		return true
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.rng.Float64() < p
+}
+
+// Wrap returns conn with the fault rules applied to everything written to it
+func (fi *FaultInjector) Wrap(conn net.Conn) net.Conn {
+	return &FaultConn{
+		Conn:     conn,
+		injector: fi,
+		sent:     make(map[FrameType]int),
+		applied:  make(map[int]int),
+		closed:   make(chan struct{}),
+	}
+}
+
+// FaultConn is a net.Conn misbehaving according to a FaultInjector. Every
+// Write is expected to carry a single frame, as the server does.
+type FaultConn struct {
+	net.Conn
+	injector  *FaultInjector
+	sent      map[FrameType]int // frames written so far by type
+	applied   map[int]int       // times each rule was applied
+	gen       int               // generation of the rules counted in applied
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *FaultConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *FaultConn) Write(b []byte) (int, error) {
+	frameType := frameTypeOf(b)
+	c.sent[frameType]++
+
+	faults, gen := c.injector.rules()
+	if gen != c.gen {
+		// Count limits start over with new rules
+		clear(c.applied)
+		c.gen = gen
+	}
+
+	out := append([]byte(nil), b...)
+	var chunk int
+	var pause time.Duration
+	for i, f := range faults {
+		if !f.targets(frameType) || c.sent[frameType] <= f.After {
+			continue
+		}
+		if f.Count > 0 && c.applied[i] >= f.Count {
+			continue
+		}
+		if !c.injector.chance(f.Probability) {
+			continue
+		}
+		c.applied[i]++
+		log.Printf("Injecting fault %s into %s frame", f, frameType)
+
+		switch f.Kind {
+		case FaultDrop:
+			return len(b), nil
+		case FaultClose:
+			c.Close()
+			return 0, net.ErrClosed
+		case FaultNAK:
+			out = BuildNAKResponse()
+		case FaultCorruptChecksum:
+			if len(out) >= 3 {
+				out[len(out)-3] ^= 0xFF
+				out[len(out)-2] ^= 0xFF
+			}
+		case FaultFlipMarkers:
+			out[0] = ETX
+			if out[len(out)-1] == ETB {
+				out[len(out)-1] = ETX
+			} else {
+				out[len(out)-1] = ETB
+			}
+		case FaultSplit:
+			chunk = max(f.Chunk, 1)
+			pause = time.Duration(f.Delay)
+		case FaultDelay:
+			c.sleep(time.Duration(f.Delay))
+		case FaultStall:
+			if f.Delay == 0 {
+				<-c.closed
+				return 0, net.ErrClosed
+			}
+			c.sleep(time.Duration(f.Delay))
+		}
+	}
+
+	if chunk == 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	for len(out) > 0 {
+		n := min(chunk, len(out))
+		if _, err := c.Conn.Write(out[:n]); err != nil {
+			return 0, err
+		}
+		out = out[n:]
+		if len(out) > 0 {
+			c.sleep(pause)
+		}
+	}
+	return len(b), nil
+}
+
+// sleep waits for d or until the connection is closed
+func (c *FaultConn) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-c.closed:
+	}
+}
@@ -0,0 +1,63 @@
+package fakelpm
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// recordConn is a net.Conn keeping what is written to it
+type recordConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func TestFrameTypeOf(t *testing.T) {
+	frames, types := testStream(t)
+	for i, f := range frames {
+		if got := frameTypeOf(f); got != types[i] {
+			t.Errorf("frame %d: got %s, want %s", i, got, types[i])
+		}
+		if got := frameTypeOf(f[:len(f)-1]); got != FrameUnknown {
+			t.Errorf("truncated frame %d: got %s", i, got)
+		}
+	}
+	if got := frameTypeOf(bytes.Join(frames[:2], nil)); got != FrameUnknown {
+		t.Errorf("two frames: got %s", got)
+	}
+}
+
+func TestFaultConnCount(t *testing.T) {
+	drop := []Fault{{Kind: FaultDrop, Frames: []string{"ACK"}, Count: 1}}
+	injector := NewFaultInjector(drop, nil)
+	rec := &recordConn{}
+	conn := injector.Wrap(rec)
+
+	write := func() {
+		t.Helper()
+		rec.buf.Reset()
+		if _, err := conn.Write(BuildACKResponse()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write()
+	if rec.buf.Len() != 0 {
+		t.Fatal("first ACK not dropped")
+	}
+	write()
+	if rec.buf.Len() == 0 {
+		t.Fatal("ACK dropped beyond the rule count")
+	}
+
+	// New rules start with their count unused
+	injector.SetFaults(drop)
+	write()
+	if rec.buf.Len() != 0 {
+		t.Fatal("first ACK after SetFaults not dropped")
+	}
+}
@@ -0,0 +1,291 @@
+package fakelpm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Frame lengths on the wire, markers included
+const (
+	RequestLen     = 22
+	HeaderLen      = 35
+	MeasurementLen = 56
+	FinalLen       = 11
+	ResponseLen    = 11 // ACK, NAK and MSR
+)
+
+// FrameType identifies the kind of frame returned by a FrameReader
+type FrameType int
+
+const (
+	FrameUnknown FrameType = iota
+	FrameRequest
+	FrameHeader
+	FrameMeasurement
+	FrameFinal
+	FrameACK
+	FrameNAK
+	FrameMSR
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameRequest:
+		return "Request"
+	case FrameHeader:
+		return "Header"
+	case FrameMeasurement:
+		return "Measurement"
+	case FrameFinal:
+		return "Final"
+	case FrameACK:
+		return "ACK"
+	case FrameNAK:
+		return "NAK"
+	case FrameMSR:
+		return "MSR"
+	}
+	return "Unknown"
+}
+
+// ParseFrameType returns the frame type with the given name, ignoring case
+func ParseFrameType(name string) (FrameType, error) {
+	for t := FrameRequest; t <= FrameMSR; t++ {
+		if strings.EqualFold(t.String(), name) {
+			return t, nil
+		}
+	}
+	return FrameUnknown, fmt.Errorf("unknown frame type %q", name)
+}
+
+// Frame is a single decoded frame. Raw always holds the bytes as received,
+// only the field matching Type is set.
+type Frame struct {
+	Type        FrameType
+	Raw         []byte
+	Request     *Request
+	Header      *Header
+	Measurement *Measurement
+	Final       *Final
+}
+
+// FrameError is returned when a frame was correctly delimited but its content
+// did not validate (usually a bad checksum). The reader is already positioned
+// after the frame, so the caller can NAK it and keep reading.
+type FrameError struct {
+	Type FrameType
+	Raw  []byte
+	Err  error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("invalid %s frame: %v", e.Type, e.Err)
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// FrameReader splits a byte stream into protocol frames. It does not rely on
+// read boundaries: fragmented or coalesced writes are handled, and garbage
+// between frames is skipped by resynchronising on the next STX.
+type FrameReader struct {
+	r *bufio.Reader
+
+	// Skipped counts the bytes discarded while looking for a valid frame
+	Skipped int
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r)}
+}
+
+// Buffered returns the number of bytes already read from the underlying
+// reader but not yet returned as frames
+func (fr *FrameReader) Buffered() int {
+	return fr.r.Buffered()
+}
+
+// ReadFrame returns the next frame in the stream. A *FrameError is returned
+// for frames that fail validation, any other error comes from the underlying
+// reader (io.ErrUnexpectedEOF if the stream ends in the middle of a frame).
+func (fr *FrameReader) ReadFrame() (*Frame, error) {
+	truncated := false
+	for {
+		if err := fr.sync(); err != nil {
+			if err == io.EOF && truncated {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		typ, length, err := fr.classify()
+		if err == io.ErrUnexpectedEOF {
+			// The stream ends before the frame does, it may be a false
+			// start with whole frames after it
+			truncated = true
+			fr.skip(1)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if typ == FrameUnknown {
+			fr.skip(1)
+			continue
+		}
+
+		raw, err := fr.peek(length)
+		if err == io.ErrUnexpectedEOF {
+			truncated = true
+			fr.skip(1)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if raw[length-1] != FrameTerminator(typ) {
+			// Not a real frame start, look for the next STX
+			fr.skip(1)
+			continue
+		}
+
+		frame := &Frame{Type: typ, Raw: append([]byte(nil), raw...)}
+		fr.r.Discard(length)
+
+		if err := frame.decode(); err != nil {
+			return nil, &FrameError{Type: typ, Raw: frame.Raw, Err: err}
+		}
+		return frame, nil
+	}
+}
+
+// sync discards bytes until the next STX, leaving it unread
+func (fr *FrameReader) sync() error {
+	for {
+		b, err := fr.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == STX {
+			return fr.r.UnreadByte()
+		}
+		fr.Skipped++
+	}
+}
+
+// classify looks at the bytes following STX to guess the frame type and its
+// total length
+func (fr *FrameReader) classify() (FrameType, int, error) {
+	need := 3
+	for {
+		prefix, err := fr.peek(need)
+		if err != nil {
+			return FrameUnknown, 0, err
+		}
+		typ, length, more := ClassifyPrefix(prefix)
+		if more == 0 {
+			return typ, length, nil
+		}
+		need = more
+	}
+}
+
+// ClassifyPrefix guesses the frame type and total length from the start of
+// a frame, STX included. When prefix is too short to tell, more is the
+// prefix length needed.
+func ClassifyPrefix(prefix []byte) (typ FrameType, length, more int) {
+	if len(prefix) < 3 {
+		return FrameUnknown, 0, 3
+	}
+	if string(prefix[1:3]) == Protocol {
+		return FrameRequest, RequestLen, 0
+	}
+
+	if len(prefix) < 5 {
+		return FrameUnknown, 0, 5
+	}
+	switch string(prefix[1:5]) {
+	case "PC" + HeaderMsgType:
+		return FrameHeader, HeaderLen, 0
+
+	case "PCR0":
+		if len(prefix) < ResponseLen {
+			return FrameUnknown, 0, ResponseLen
+		}
+		switch string(prefix[5:8]) {
+		case "ACK":
+			return FrameACK, ResponseLen, 0
+		case "NAK":
+			return FrameNAK, ResponseLen, 0
+		case "MSR":
+			return FrameMSR, ResponseLen, 0
+		}
+
+	case "PC" + MeasurementMsgType:
+		// The Final frame shares the D4 block type, it is told apart by the
+		// EOD marker and its ETX at the expected position. A measurement
+		// cannot start with "EOD" as byte 7 is a BCD month.
+		if len(prefix) < FinalLen {
+			return FrameUnknown, 0, FinalLen
+		}
+		if string(prefix[5:8]) == "EOD" && prefix[FinalLen-1] == ETX {
+			return FrameFinal, FinalLen, 0
+		}
+		return FrameMeasurement, MeasurementLen, 0
+	}
+
+	return FrameUnknown, 0, 0
+}
+
+// frameTypeOf returns the type of the single frame b from its start, length
+// and terminator, without validating its content
+func frameTypeOf(b []byte) FrameType {
+	if len(b) == 0 || b[0] != STX {
+		return FrameUnknown
+	}
+	typ, length, _ := ClassifyPrefix(b)
+	if typ == FrameUnknown || len(b) != length || b[length-1] != FrameTerminator(typ) {
+		return FrameUnknown
+	}
+	return typ
+}
+
+func (fr *FrameReader) peek(n int) ([]byte, error) {
+	b, err := fr.r.Peek(n)
+	if err == io.EOF && len(b) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+func (fr *FrameReader) skip(n int) {
+	d, _ := fr.r.Discard(n)
+	fr.Skipped += d
+}
+
+// FrameTerminator returns the byte ending frames of type t
+func FrameTerminator(t FrameType) byte {
+	switch t {
+	case FrameHeader, FrameMeasurement:
+		return ETB
+	}
+	return ETX
+}
+
+func (f *Frame) decode() error {
+	var err error
+	switch f.Type {
+	case FrameRequest:
+		f.Request, err = ParseRequest(f.Raw)
+	case FrameHeader:
+		f.Header, err = ParseHeader(f.Raw)
+	case FrameMeasurement:
+		f.Measurement, err = ParseMeasurement(f.Raw)
+	case FrameFinal:
+		f.Final, err = ParseFinal(f.Raw)
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package fakelpm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// testStream returns a download as seen on the wire, one frame of each type
+func testStream(t *testing.T) ([][]byte, []FrameType) {
+	t.Helper()
+
+	req := NewRequest()
+	req.CalculateRequestChecksum()
+
+	header, err := HeaderInfo{
+		UserCode:  "0001",
+		PlantCode: "0001",
+		Time:      time.Date(2024, 6, 7, 12, 30, 0, 0, time.UTC),
+	}.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	final := NewFinal()
+	final.CalculateFinalChecksum()
+
+	frames := [][]byte{
+		BuildACKResponse(),
+		req.Bytes(),
+		header.Bytes(),
+		NewRandomMeasurement().Bytes(),
+		BuildACKMeasureResponse(),
+		final.Bytes(),
+		BuildNAKResponse(),
+	}
+	types := []FrameType{FrameACK, FrameRequest, FrameHeader, FrameMeasurement, FrameMSR, FrameFinal, FrameNAK}
+	return frames, types
+}
+
+func TestFrameReader(t *testing.T) {
+	frames, types := testStream(t)
+	stream := bytes.Join(frames, nil)
+
+	var garbled bytes.Buffer
+	for _, f := range frames {
+		// Noise and a stray STX before each frame
+		garbled.Write([]byte{0x00, 0xFF, STX, 'x', STX, 'P', 'C', 'R', '0'})
+		garbled.Write(f)
+	}
+
+	tests := []struct {
+		name    string
+		r       io.Reader
+		skipped bool
+	}{
+		{"coalesced", bytes.NewReader(stream), false},
+		{"one byte reads", iotest.OneByteReader(bytes.NewReader(stream)), false},
+		{"half reads", iotest.HalfReader(bytes.NewReader(stream)), false},
+		{"garbage between frames", bytes.NewReader(garbled.Bytes()), true},
+		{"garbage in one byte reads", iotest.OneByteReader(bytes.NewReader(garbled.Bytes())), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fr := NewFrameReader(tt.r)
+			for i, want := range types {
+				frame, err := fr.ReadFrame()
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if frame.Type != want {
+					t.Fatalf("frame %d: got %s, want %s", i, frame.Type, want)
+				}
+				if !bytes.Equal(frame.Raw, frames[i]) {
+					t.Fatalf("frame %d: got % X, want % X", i, frame.Raw, frames[i])
+				}
+			}
+			if _, err := fr.ReadFrame(); err != io.EOF {
+				t.Fatalf("got %v at the end of the stream, want EOF", err)
+			}
+			if tt.skipped != (fr.Skipped > 0) {
+				t.Errorf("skipped %d bytes", fr.Skipped)
+			}
+		})
+	}
+}
+
+func TestFrameReaderChecksum(t *testing.T) {
+	frames, _ := testStream(t)
+	bad := append([]byte(nil), frames[3]...)
+	bad[10] ^= 0xFF
+
+	fr := NewFrameReader(bytes.NewReader(bytes.Join([][]byte{bad, frames[5]}, nil)))
+
+	_, err := fr.ReadFrame()
+	var frameErr *FrameError
+	if !errors.As(err, &frameErr) || frameErr.Type != FrameMeasurement {
+		t.Fatalf("got %v, want a Measurement FrameError", err)
+	}
+
+	// The reader keeps going after an invalid frame
+	frame, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != FrameFinal {
+		t.Fatalf("got %s, want Final", frame.Type)
+	}
+}
+
+func TestFrameReaderFalseStart(t *testing.T) {
+	frames, _ := testStream(t)
+
+	// The start of a measurement, cut short, right before the last frames
+	var stream bytes.Buffer
+	stream.Write([]byte{STX, 'P', 'C', 'D', '4'})
+	stream.Write(frames[5])
+	stream.Write(frames[6])
+
+	fr := NewFrameReader(iotest.OneByteReader(&stream))
+	for _, want := range []FrameType{FrameFinal, FrameNAK} {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type != want {
+			t.Fatalf("got %s, want %s", frame.Type, want)
+		}
+	}
+	if _, err := fr.ReadFrame(); err != io.EOF {
+		t.Fatalf("got %v at the end of the stream, want EOF", err)
+	}
+}
+
+func TestFrameReaderTruncated(t *testing.T) {
+	frames, _ := testStream(t)
+	fr := NewFrameReader(bytes.NewReader(frames[3][:30]))
+
+	if _, err := fr.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -0,0 +1,169 @@
+package fakelpm
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// SWVersion is the firmware version of a concentrator, sent in the Header as
+// one byte per number
+type SWVersion struct {
+	Major uint8 `json:"major"`
+	Minor uint8 `json:"minor"`
+	Patch uint8 `json:"patch"`
+	Build uint8 `json:"build"`
+}
+
+// SWVersionOf returns the version written in the 4 SWVersion bytes of a Header
+func SWVersionOf(b [4]byte) SWVersion {
+	return SWVersion{Major: b[0], Minor: b[1], Patch: b[2], Build: b[3]}
+}
+
+// Bytes returns the version as written in a Header
+func (v SWVersion) Bytes() [4]byte {
+	return [4]byte{v.Major, v.Minor, v.Patch, v.Build}
+}
+
+func (v SWVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d.%d", v.Major, v.Minor, v.Patch, v.Build)
+}
+
+// Compare returns -1, 0 or +1 as v is older than, the same as or newer than w
+func (v SWVersion) Compare(w SWVersion) int {
+	a, b := v.Bytes(), w.Bytes()
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// HeaderInfo is the content of a Header block
+type HeaderInfo struct {
+	UserCode  string
+	PlantCode string
+	Time      time.Time // concentrator clock, to the minute
+	RAM       bool
+	SWVersion SWVersion
+}
+
+// Info decodes the header, the date and time are those of the concentrator
+// clock in loc. Numeric fields are read as ASCII digits, or as a BCD byte
+// followed by zero padding as older servers write them.
+func (header *Header) Info(loc *time.Location) (HeaderInfo, error) {
+	info := HeaderInfo{
+		UserCode:  string(header.UserCode[:]),
+		PlantCode: string(header.PlantCode[:]),
+		RAM:       header.RAM != 0,
+		SWVersion: SWVersionOf(header.SWVersion),
+	}
+
+	fields := []struct {
+		name string
+		b    []byte
+	}{
+		{"day", header.Day[:]},
+		{"month", header.Month[:]},
+		{"year", header.Year[:]},
+		{"hour", header.Hour[:]},
+		{"minute", header.Minute[:]},
+	}
+	var v [5]int
+	for i, f := range fields {
+		n, legacy, err := HeaderNumber(f.b)
+		if err != nil {
+			return info, fmt.Errorf("invalid %s: %v", f.name, err)
+		}
+		if legacy && f.name == "year" {
+			n += 2000
+		}
+		v[i] = n
+	}
+	day, month, year, hour, minute := v[0], v[1], v[2], v[3], v[4]
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || minute > 59 {
+		return info, fmt.Errorf("invalid date %04d-%02d-%02d %02d:%02d", year, month, day, hour, minute)
+	}
+	info.Time = time.Date(year, time.Month(month), day, hour, minute, 0, 0, loc)
+	if info.Time.Day() != day {
+		return info, fmt.Errorf("invalid date %04d-%02d-%02d", year, month, day)
+	}
+	return info, nil
+}
+
+// HeaderNumber decodes a numeric Header field, legacy is true when it is
+// written as a BCD byte followed by zero padding
+func HeaderNumber(b []byte) (n int, legacy bool, err error) {
+	ascii := true
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			ascii = false
+		}
+	}
+	if ascii {
+		n, err = strconv.Atoi(string(b))
+		return n, false, err
+	}
+	for _, c := range b[1:] {
+		if c != 0 {
+			return 0, false, fmt.Errorf("%X is neither ASCII digits nor BCD", b)
+		}
+	}
+	n, err = bcdToInt(b[0])
+	return n, true, err
+}
+
+// Header encodes the info as a Header block, with its checksum. The date and
+// time are written as ASCII digits in the location of Time.
+func (info HeaderInfo) Header() (*Header, error) {
+	header := NewHeader()
+	var err error
+	if header.UserCode, err = ParseCode(info.UserCode); err != nil {
+		return nil, fmt.Errorf("invalid user code: %v", err)
+	}
+	if header.PlantCode, err = ParseCode(info.PlantCode); err != nil {
+		return nil, fmt.Errorf("invalid plant code: %v", err)
+	}
+
+	t := info.Time
+	if t.Year() < 0 || t.Year() > 9999 {
+		return nil, fmt.Errorf("year %d does not fit the header", t.Year())
+	}
+	copy(header.Day[:], fmt.Sprintf("%02d", t.Day()))
+	copy(header.Month[:], fmt.Sprintf("%02d", int(t.Month())))
+	copy(header.Year[:], fmt.Sprintf("%04d", t.Year()))
+	copy(header.Hour[:], fmt.Sprintf("%02d", t.Hour()))
+	copy(header.Minute[:], fmt.Sprintf("%02d", t.Minute()))
+
+	if info.RAM {
+		header.RAM = 0x01
+	}
+	header.SWVersion = info.SWVersion.Bytes()
+	header.CalculateHeaderChecksum()
+	return header, nil
+}
+
+// Bytes returns the 35 bytes of the header block
+func (header *Header) Bytes() []byte {
+	b := make([]byte, HeaderLen)
+	b[0] = header.STX
+	copy(b[1:3], header.Computer[:])
+	copy(b[3:5], header.IntestationBlock[:])
+	copy(b[5:7], header.Model[:])
+	copy(b[7:11], header.UserCode[:])
+	copy(b[11:15], header.PlantCode[:])
+	copy(b[15:17], header.Day[:])
+	copy(b[17:19], header.Month[:])
+	copy(b[19:23], header.Year[:])
+	copy(b[23:25], header.Hour[:])
+	copy(b[25:27], header.Minute[:])
+	b[27] = header.RAM
+	copy(b[28:32], header.SWVersion[:])
+	copy(b[32:34], header.Checksum[:])
+	b[34] = header.ETB
+	return b
+}
@@ -0,0 +1,137 @@
+package fakelpm
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestHeaderInfoEncode(t *testing.T) {
+	rome, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		name string
+		info HeaderInfo
+		want string // Day to Minute as written on the wire
+	}{
+		{"utc", HeaderInfo{UserCode: "0001", PlantCode: "0002", Time: time.Date(2024, 6, 7, 9, 5, 0, 0, time.UTC)}, "070620240905"},
+		{"end of year", HeaderInfo{UserCode: "1", PlantCode: "22", Time: time.Date(2023, 12, 31, 23, 59, 0, 0, time.UTC)}, "311220232359"},
+		{"local time", HeaderInfo{UserCode: "0001", PlantCode: "0001", Time: time.Date(2024, 1, 2, 3, 4, 0, 0, rome)}, "020120240304"},
+		{"ram and version", HeaderInfo{UserCode: "ABCD", PlantCode: "0001", Time: time.Date(2030, 10, 1, 0, 0, 0, 0, time.UTC), RAM: true, SWVersion: SWVersion{1, 2, 3, 4}}, "011020300000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := tt.info.Header()
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw := header.Bytes()
+			if len(raw) != HeaderLen {
+				t.Fatalf("got %d bytes, want %d", len(raw), HeaderLen)
+			}
+			if got := string(raw[15:27]); got != tt.want {
+				t.Errorf("date and time %q, want %q", got, tt.want)
+			}
+
+			// The header must parse back, checksum included
+			parsed, err := ParseHeader(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := parsed.Info(tt.info.Time.Location())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.info
+			want.UserCode = string(header.UserCode[:])
+			want.PlantCode = string(header.PlantCode[:])
+			if info != want {
+				t.Errorf("got %+v, want %+v", info, want)
+			}
+		})
+	}
+}
+
+func TestHeaderInfoEncodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		info HeaderInfo
+	}{
+		{"long user code", HeaderInfo{UserCode: "00001", PlantCode: "0001", Time: time.Now()}},
+		{"bad plant code", HeaderInfo{UserCode: "0001", PlantCode: "\x01", Time: time.Now()}},
+		{"year too large", HeaderInfo{UserCode: "0001", PlantCode: "0001", Time: time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)}},
+	}
+
+	for _, tt := range tests {
+		if _, err := tt.info.Header(); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestHeaderInfoDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  [5][]byte // Day, Month, Year, Hour, Minute
+		want    time.Time
+		wantErr bool
+	}{
+		{"ascii", [5][]byte{[]byte("07"), []byte("06"), []byte("2024"), []byte("09"), []byte("05")}, time.Date(2024, 6, 7, 9, 5, 0, 0, time.UTC), false},
+		{"legacy bcd", [5][]byte{{0x07, 0}, {0x06, 0}, {0x24, 0, 0, 0}, {0x09, 0}, {0x05, 0}}, time.Date(2024, 6, 7, 9, 5, 0, 0, time.UTC), false},
+		{"legacy bcd end of year", [5][]byte{{0x31, 0}, {0x12, 0}, {0x99, 0, 0, 0}, {0x23, 0}, {0x59, 0}}, time.Date(2099, 12, 31, 23, 59, 0, 0, time.UTC), false},
+		{"mixed", [5][]byte{[]byte("07"), {0x06, 0}, []byte("2024"), {0x09, 0}, []byte("05")}, time.Date(2024, 6, 7, 9, 5, 0, 0, time.UTC), false},
+		{"invalid bcd", [5][]byte{{0x1A, 0}, {0x06, 0}, {0x24, 0, 0, 0}, {0x09, 0}, {0x05, 0}}, time.Time{}, true},
+		{"no padding", [5][]byte{{0x07, 0x01}, {0x06, 0}, {0x24, 0, 0, 0}, {0x09, 0}, {0x05, 0}}, time.Time{}, true},
+		{"month out of range", [5][]byte{[]byte("07"), []byte("13"), []byte("2024"), []byte("09"), []byte("05")}, time.Time{}, true},
+		{"day out of month", [5][]byte{[]byte("31"), []byte("04"), []byte("2024"), []byte("09"), []byte("05")}, time.Time{}, true},
+		{"hour out of range", [5][]byte{[]byte("07"), []byte("06"), []byte("2024"), []byte("24"), []byte("05")}, time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := NewHeader()
+			copy(header.Day[:], tt.fields[0])
+			copy(header.Month[:], tt.fields[1])
+			copy(header.Year[:], tt.fields[2])
+			copy(header.Hour[:], tt.fields[3])
+			copy(header.Minute[:], tt.fields[4])
+
+			info, err := header.Info(time.UTC)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !info.Time.Equal(tt.want) {
+				t.Errorf("got %s, want %s", info.Time, tt.want)
+			}
+		})
+	}
+}
+
+func TestSWVersion(t *testing.T) {
+	v := SWVersionOf([4]byte{1, 2, 3, 4})
+	if v.String() != "1.2.3.4" {
+		t.Errorf("got %s, want 1.2.3.4", v)
+	}
+	b := v.Bytes()
+	if !bytes.Equal(b[:], []byte{1, 2, 3, 4}) {
+		t.Errorf("got % X", b)
+	}
+
+	tests := []struct {
+		a, b SWVersion
+		want int
+	}{
+		{SWVersion{1, 2, 3, 4}, SWVersion{1, 2, 3, 4}, 0},
+		{SWVersion{1, 2, 3, 4}, SWVersion{1, 3, 0, 0}, -1},
+		{SWVersion{2, 0, 0, 0}, SWVersion{1, 9, 9, 9}, 1},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Compare(tt.b); got != tt.want {
+			t.Errorf("%s.Compare(%s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package fakelpm
+
+import (
+	"sync"
+	"time"
+)
+
+// HistoryRecord is a Data block kept in a plant history. Seq starts at 1 and
+// grows by one for every record appended to the same plant.
+type HistoryRecord struct {
+	Seq      uint64
+	Produced time.Time
+	Data     [48]byte
+}
+
+// HistoryStore keeps the measurement history of every plant, and the read
+// cursor of every UserCode/PlantCode pair used by partial downloads. A cursor
+// is the Seq of the last record acknowledged by that client.
+type HistoryStore interface {
+	// Append adds blocks to the history of plant, skipping those already
+	// in it so that a seeded plant simulated again is not served twice
+	Append(plant string, produced time.Time, data ...[48]byte) error
+	// Records returns the records of plant with Seq greater than after, at
+	// most limit of them (0 means no limit)
+	Records(plant string, after uint64, limit int) ([]HistoryRecord, error)
+	Cursor(user, plant string) (uint64, error)
+	SetCursor(user, plant string, seq uint64) error
+	// Clear drops the records of plant, the Seq of the next records keeps
+	// growing from the last one so that cursors stay valid
+	Clear(plant string) error
+}
+
+type cursorKey struct {
+	user  string
+	plant string
+}
+
+// MemoryHistory is a HistoryStore living for the lifetime of the process
+type MemoryHistory struct {
+	mu      sync.Mutex
+	plants  map[string][]HistoryRecord
+	blocks  map[string]map[[48]byte]bool // Data of the records of a plant
+	last    map[string]uint64
+	cursors map[cursorKey]uint64
+}
+
+func NewMemoryHistory() *MemoryHistory {
+	return &MemoryHistory{
+		plants:  make(map[string][]HistoryRecord),
+		blocks:  make(map[string]map[[48]byte]bool),
+		last:    make(map[string]uint64),
+		cursors: make(map[cursorKey]uint64),
+	}
+}
+
+func (h *MemoryHistory) Append(plant string, produced time.Time, data ...[48]byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	records := h.plants[plant]
+	blocks := h.blocks[plant]
+	if blocks == nil {
+		blocks = make(map[[48]byte]bool)
+		h.blocks[plant] = blocks
+	}
+	seq := h.last[plant]
+	for _, d := range data {
+		if blocks[d] {
+			continue
+		}
+		blocks[d] = true
+		seq++
+		records = append(records, HistoryRecord{Seq: seq, Produced: produced, Data: d})
+	}
+	h.plants[plant] = records
+	h.last[plant] = seq
+	return nil
+}
+
+func (h *MemoryHistory) Records(plant string, after uint64, limit int) ([]HistoryRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var result []HistoryRecord
+	for _, r := range h.plants[plant] {
+		if r.Seq <= after {
+			continue
+		}
+		if limit > 0 && len(result) == limit {
+			break
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func (h *MemoryHistory) Cursor(user, plant string) (uint64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cursors[cursorKey{user, plant}], nil
+}
+
+func (h *MemoryHistory) SetCursor(user, plant string, seq uint64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cursors[cursorKey{user, plant}] = seq
+	return nil
+}
+
+func (h *MemoryHistory) Clear(plant string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.plants, plant)
+	delete(h.blocks, plant)
+	return nil
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"FakeLPM/fakelpm"
+)
+
+// Frame dissector: reads hex, base64 or binary data from a file or stdin and
+// prints every frame or Data block found in it, field by field
+func main() {
+	format := flag.String("format", "auto", "Input format: auto, hex, base64 or binary")
+	location := flag.String("location", "", "IANA time zone of the concentrator, for block timestamps (local when empty)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [file]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+
+	loc := time.Local
+	if *location != "" {
+		var err error
+		if loc, err = time.LoadLocation(*location); err != nil {
+			log.Fatalf("Invalid location: %v", err)
+		}
+	}
+
+	var input []byte
+	var err error
+	switch flag.NArg() {
+	case 0:
+		input, err = io.ReadAll(os.Stdin)
+	case 1:
+		input, err = os.ReadFile(flag.Arg(0))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read input: %v", err)
+	}
+
+	data, kind, err := decodeInput(input, *format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Input: %s, %d bytes\n", kind, len(data))
+
+	// Historical measures format: "D4" and the hex encoding of Data blocks
+	if blocks, ok := historicalBlocks(data); ok {
+		fmt.Printf("Historical measures, %d Data blocks\n", len(blocks)/48)
+		data = blocks
+	}
+
+	if len(data) > 0 && data[0] != fakelpm.STX && len(data)%48 == 0 {
+		for i := 0; i < len(data); i += 48 {
+			fmt.Printf("\nData block %d @%d\n", i/48+1, i)
+			dissectData(data[i:i+48], loc, "  ")
+		}
+		return
+	}
+
+	if n := scanFrames(data, loc); n == 0 {
+		os.Exit(1)
+	}
+}
+
+// decodeInput turns the input into raw bytes according to format, guessing
+// it when format is auto
+func decodeInput(input []byte, format string) ([]byte, string, error) {
+	switch format {
+	case "binary":
+		return input, "binary", nil
+	case "hex":
+		data, err := decodeHex(input)
+		return data, "hex", err
+	case "base64":
+		data, err := decodeBase64(input)
+		return data, "base64", err
+	case "auto":
+		// A historical dump is also valid hex, "D4" would be read as a byte
+		if _, ok := historicalBlocks(bytes.TrimSpace(input)); ok {
+			return bytes.TrimSpace(input), "historical measures", nil
+		}
+		if data, err := decodeHex(input); err == nil {
+			return data, "hex", nil
+		}
+		if data, err := decodeBase64(input); err == nil {
+			return data, "base64", nil
+		}
+		return input, "binary", nil
+	}
+	return nil, "", fmt.Errorf("unknown input format %q", format)
+}
+
+// decodeHex accepts hex digits separated by whitespace, colons, dashes or
+// commas, with optional 0x prefixes
+func decodeHex(input []byte) ([]byte, error) {
+	s := strings.NewReplacer("0x", " ", "0X", " ", ":", " ", "-", " ", ",", " ").Replace(string(input))
+	s = strings.Join(strings.Fields(s), "")
+	if s == "" {
+		return nil, fmt.Errorf("empty hex input")
+	}
+	return hex.DecodeString(s)
+}
+
+func decodeBase64(input []byte) ([]byte, error) {
+	s := strings.Join(strings.Fields(string(input)), "")
+	if s == "" {
+		return nil, fmt.Errorf("empty base64 input")
+	}
+	if data, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return data, nil
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// historicalBlocks recognizes the historical measures format and returns the
+// Data blocks it holds. The format read as hex, a 0xD4 byte followed by the
+// blocks, is recognized too.
+func historicalBlocks(data []byte) ([]byte, bool) {
+	if len(data) > 1 && data[0] == 0xD4 && (len(data)-1)%48 == 0 {
+		return data[1:], true
+	}
+	if !bytes.HasPrefix(data, []byte(fakelpm.MeasurementMsgType)) {
+		return nil, false
+	}
+	blocks, err := hex.DecodeString(string(bytes.TrimSpace(data[2:])))
+	if err != nil || len(blocks) == 0 || len(blocks)%48 != 0 {
+		return nil, false
+	}
+	return blocks, true
+}
+
+// scanFrames prints every frame found in data and returns how many there
+// were. Frames are recognized like fakelpm.FrameReader does.
+func scanFrames(data []byte, loc *time.Location) int {
+	count := 0
+	garbage := -1 // start of the bytes not belonging to any frame
+	flush := func(end int) {
+		if garbage >= 0 {
+			fmt.Printf("\n%d bytes @%d not part of a frame: %X\n", end-garbage, garbage, data[garbage:end])
+			garbage = -1
+		}
+	}
+
+	for pos := 0; pos < len(data); {
+		typ, length := fakelpm.FrameUnknown, 0
+		if data[pos] == fakelpm.STX {
+			typ, length, _ = fakelpm.ClassifyPrefix(data[pos:])
+		}
+		// Like FrameReader, a start running past the end of the data or
+		// without the expected terminator may be a false start
+		switch {
+		case typ == fakelpm.FrameUnknown:
+		case pos+length > len(data):
+			flush(pos)
+			fmt.Printf("\n%s start @%d truncated (%d of %d bytes), resyncing\n", typ, pos, len(data)-pos, length)
+			typ = fakelpm.FrameUnknown
+		case data[pos+length-1] != fakelpm.FrameTerminator(typ):
+			flush(pos)
+			fmt.Printf("\n%s start @%d: bad terminator %02X, expected %02X, resyncing\n",
+				typ, pos, data[pos+length-1], fakelpm.FrameTerminator(typ))
+			typ = fakelpm.FrameUnknown
+		}
+		if typ == fakelpm.FrameUnknown {
+			if garbage < 0 {
+				garbage = pos
+			}
+			pos++
+			continue
+		}
+		flush(pos)
+
+		count++
+		dissectFrame(count, pos, typ, data[pos:pos+length], loc)
+		pos += length
+	}
+	flush(len(data))
+
+	if count == 0 {
+		fmt.Println("No frame found")
+	}
+	return count
+}
+
+func dissectFrame(n, pos int, typ fakelpm.FrameType, raw []byte, loc *time.Location) {
+	var err error
+	switch typ {
+	case fakelpm.FrameRequest:
+		_, err = fakelpm.ParseRequest(raw)
+	case fakelpm.FrameHeader:
+		_, err = fakelpm.ParseHeader(raw)
+	case fakelpm.FrameMeasurement:
+		_, err = fakelpm.ParseMeasurement(raw)
+	case fakelpm.FrameFinal:
+		_, err = fakelpm.ParseFinal(raw)
+	default:
+		if expected := expectedResponse(typ); !bytes.Equal(raw, expected) {
+			err = fmt.Errorf("unexpected content, expected %X", expected)
+		}
+	}
+
+	status := "valid"
+	if err != nil {
+		status = fmt.Sprintf("INVALID: %v", err)
+	}
+	fmt.Printf("\nFrame %d @%d: %s (%d bytes) %s\n", n, pos, typ, len(raw), status)
+
+	switch typ {
+	case fakelpm.FrameRequest:
+		field("STX", raw[0:1], "")
+		field("Protocol", raw[1:3], quoted(raw[1:3]))
+		field("UserCode", raw[3:7], quoted(raw[3:7]))
+		field("PlantCode", raw[7:11], quoted(raw[7:11]))
+		field("Command", raw[11:13], quoted(raw[11:13])+commandName(raw[11:13]))
+		field("BlockSel", raw[13:14], blockSel(raw[13]))
+		reserved := ""
+		if raw[14]&fakelpm.RequestResume != 0 {
+			reserved = "resume"
+		}
+		field("Reserved", raw[14:15], reserved)
+		maxRec := binary.BigEndian.Uint32(raw[15:19])
+		if maxRec == 0 {
+			field("MaxRec", raw[15:19], "all records")
+		} else {
+			field("MaxRec", raw[15:19], fmt.Sprintf("%d records", maxRec))
+		}
+		field("Checksum", raw[19:21], "")
+		field("ETX", raw[21:22], "")
+
+	case fakelpm.FrameHeader:
+		field("STX", raw[0:1], "")
+		field("Computer", raw[1:3], quoted(raw[1:3]))
+		field("Block", raw[3:5], quoted(raw[3:5]))
+		field("Model", raw[5:7], quoted(raw[5:7]))
+		field("UserCode", raw[7:11], quoted(raw[7:11]))
+		field("PlantCode", raw[11:15], quoted(raw[11:15]))
+		field("Day", raw[15:17], number(raw[15:17]))
+		field("Month", raw[17:19], number(raw[17:19]))
+		field("Year", raw[19:23], number(raw[19:23]))
+		field("Hour", raw[23:25], number(raw[23:25]))
+		field("Minute", raw[25:27], number(raw[25:27]))
+		field("RAM", raw[27:28], "")
+		field("SWVersion", raw[28:32], fakelpm.SWVersionOf([4]byte(raw[28:32])).String())
+		field("Checksum", raw[32:34], "")
+		field("ETB", raw[34:35], "")
+		if header, err := fakelpm.ParseHeader(raw); err == nil {
+			if info, err := header.Info(loc); err != nil {
+				fmt.Printf("  Concentrator clock not decoded: %v\n", err)
+			} else {
+				fmt.Printf("  Concentrator clock %s\n", info.Time.Format("2006-01-02 15:04 MST"))
+			}
+		}
+
+	case fakelpm.FrameMeasurement:
+		field("STX", raw[0:1], "")
+		field("Computer", raw[1:3], quoted(raw[1:3]))
+		field("BlockType", raw[3:5], quoted(raw[3:5]))
+		fmt.Println("  Data")
+		dissectData(raw[5:53], loc, "    ")
+		field("Checksum", raw[53:55], "")
+		field("ETB", raw[55:56], "")
+
+	case fakelpm.FrameFinal:
+		field("STX", raw[0:1], "")
+		field("Computer", raw[1:3], quoted(raw[1:3]))
+		field("EndBlock", raw[3:5], quoted(raw[3:5]))
+		field("EndDownload", raw[5:8], quoted(raw[5:8]))
+		field("Checksum", raw[8:10], "")
+		field("ETX", raw[10:11], "")
+
+	default:
+		field("STX", raw[0:1], "")
+		field("Computer", raw[1:3], quoted(raw[1:3]))
+		field("Type", raw[3:5], quoted(raw[3:5]))
+		field("Code", raw[5:8], quoted(raw[5:8]))
+		field("Check", raw[8:10], quoted(raw[8:10]))
+		field("ETX", raw[10:11], "")
+	}
+}
+
+func expectedResponse(typ fakelpm.FrameType) []byte {
+	switch typ {
+	case fakelpm.FrameACK:
+		return fakelpm.BuildACKResponse()
+	case fakelpm.FrameNAK:
+		return fakelpm.BuildNAKResponse()
+	case fakelpm.FrameMSR:
+		return fakelpm.BuildACKMeasureResponse()
+	}
+	return nil
+}
+
+// dissectData prints the fields of a 48 byte Data block and the readings
+// decoded from it
+func dissectData(d []byte, loc *time.Location, indent string) {
+	row := func(offsets, name string, b []byte, meaning string) {
+		fmt.Printf("%s%-8s %-14s % X", indent, offsets, name, b)
+		if meaning != "" {
+			fmt.Printf("  %s", meaning)
+		}
+		fmt.Println()
+	}
+
+	year := int(d[0]&0x1F)<<8 + int(d[1])
+	row("[0]", "Status", d[0:1], blockStatus(d[0]))
+	row("[0-1]", "Year", d[0:2], fmt.Sprint(year))
+	row("[2]", "Month", d[2:3], bcd(d[2]))
+	row("[3]", "Day", d[3:4], bcd(d[3]))
+	row("[4-5]", "Address", d[4:6], bcd(d[5])+bcd(d[4]))
+	measureType := "basic"
+	if d[6] == fakelpm.MeasureTypeEnergy {
+		measureType = "energy: slot 1 energy, slots 2-3 durations"
+	}
+	row("[6]", "MeasureType", d[6:7], measureType)
+
+	for idx := 0; idx < 3; idx++ {
+		o := 7 + idx*11
+		s := d[o : o+11]
+		label := func(from, to int) string {
+			if from == to {
+				return fmt.Sprintf("[%d]", o+from)
+			}
+			return fmt.Sprintf("[%d-%d]", o+from, o+to)
+		}
+		fmt.Printf("%sSlot %d\n", indent, idx+1)
+		row(label(0, 0), "  State", s[0:1], fakelpm.LampFlags(s[0]).String())
+		row(label(1, 2), "  Voltage", s[1:3], fmt.Sprintf("%d V", binary.LittleEndian.Uint16(s[1:3])))
+		row(label(3, 4), "  Current", s[3:5], fmt.Sprintf("%.3f A", float64(binary.LittleEndian.Uint16(s[3:5]))*3.57/1000))
+		low, high := binary.LittleEndian.Uint16(s[5:7]), binary.LittleEndian.Uint16(s[7:9])
+		switch {
+		case d[6] == fakelpm.MeasureTypeEnergy && idx == 0:
+			row(label(5, 8), "  Energy", s[5:9], fmt.Sprintf("%d Wh", uint32(high)<<16|uint32(low)))
+		case d[6] == fakelpm.MeasureTypeEnergy:
+			row(label(5, 6), "  Powered", s[5:7], fmt.Sprintf("%d units", low))
+			row(label(7, 8), "  Lit", s[7:9], fmt.Sprintf("%d units", high))
+		default:
+			row(label(5, 8), "  Counters", s[5:9], "")
+		}
+		row(label(9, 9), "  Cosfi", s[9:10], fmt.Sprintf("%.2f", float64(s[9])/100))
+		sign := "positive"
+		if s[10]&1 == 1 {
+			sign = "negative"
+		}
+		row(label(10, 10), "  Sign", s[10:11], sign)
+	}
+
+	for idx := 0; idx < 3; idx++ {
+		o := 40 + idx*2
+		row(fmt.Sprintf("[%d-%d]", o, o+1), fmt.Sprintf("Harvest %d", idx+1), d[o:o+2], harvest(binary.LittleEndian.Uint16(d[o:o+2])))
+	}
+	row("[46]", "Conversion", d[46:47], conversion(d[46]))
+	row("[47]", "Spare", d[47:48], "")
+
+	readings, err := fakelpm.DecodeLampBlock(d, loc)
+	switch {
+	case err != nil:
+		fmt.Printf("%sUndecodable block: %v\n", indent, err)
+	case len(readings) == 0:
+		fmt.Printf("%sNo readings (empty block)\n", indent)
+	}
+	for _, r := range readings {
+		if r.NotResponding {
+			fmt.Printf("%sReading: lamp %d not responding on the night of %s\n", indent, r.Address, r.Timestamp.Format("2006-01-02"))
+			continue
+		}
+		fmt.Printf("%sReading: lamp %d at %s, %s, %.0f V, %.3f A, cosfi %.2f, %.1f W",
+			indent, r.Address, r.Timestamp.Format(time.RFC3339), r.Flags, r.Voltage, r.Current, r.Cosfi, r.ActivePower)
+		if r.HasEnergy {
+			fmt.Printf(", energy %.0f Wh", r.Energy)
+		}
+		if r.HasDurations {
+			fmt.Printf(", powered %s, lit %s", r.Powered, r.Lit)
+		}
+		fmt.Println()
+	}
+}
+
+func field(name string, b []byte, meaning string) {
+	fmt.Printf("  %-12s % X", name, b)
+	if meaning != "" {
+		fmt.Printf("  %s", meaning)
+	}
+	fmt.Println()
+}
+
+func quoted(b []byte) string {
+	return fmt.Sprintf("%q", b)
+}
+
+func commandName(b []byte) string {
+	switch string(b) {
+	case "DT":
+		return " total download"
+	case "DP":
+		return " partial download"
+	}
+	return " unknown command"
+}
+
+func blockSel(b byte) string {
+	s := fmt.Sprintf("%08b", b)
+	if b&fakelpm.BlockSelMeasures != 0 {
+		s += " measures"
+	}
+	if b&^fakelpm.BlockSelMeasures != 0 {
+		s += " +other blocks"
+	}
+	return s
+}
+
+func blockStatus(b byte) string {
+	var names []string
+	for _, s := range []struct {
+		bit  byte
+		name string
+	}{
+		{fakelpm.BlockAcquired, "acquired"},
+		{fakelpm.BlockComplete, "complete"},
+		{fakelpm.BlockFinal, "final"},
+	} {
+		if b&s.bit != 0 {
+			names = append(names, s.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// bcd renders a BCD byte, flagging invalid digits
+func bcd(b byte) string {
+	if b>>4 > 9 || b&0x0F > 9 {
+		return fmt.Sprintf("invalid BCD %02X", b)
+	}
+	return fmt.Sprintf("%02X", b)
+}
+
+// number renders a numeric Header field, written either as ASCII digits or
+// as a BCD byte followed by padding
+func number(b []byte) string {
+	n, legacy, err := fakelpm.HeaderNumber(b)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("invalid: %v", err)
+	case legacy:
+		return fmt.Sprintf("%d (BCD)", n)
+	}
+	return fmt.Sprintf("%d (ASCII)", n)
+}
+
+func harvest(v uint16) string {
+	switch v {
+	case 0xFFFF:
+		return "empty"
+	case 0xFFFE:
+		return "not responding"
+	}
+	t := time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC).Add(time.Duration(v) * time.Minute)
+	return fmt.Sprintf("%s (%d min from noon)", t.Format("15:04"), v)
+}
+
+func conversion(b byte) string {
+	switch b {
+	case 0:
+		return "duration unit 154.3 s"
+	case 1, 2, 3:
+		return fmt.Sprintf("duration unit %d h", b)
+	}
+	return "unknown"
+}
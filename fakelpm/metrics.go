@@ -0,0 +1,214 @@
+package fakelpm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricsCollector adds its samples to a Metrics on every scrape
+type MetricsCollector interface {
+	CollectMetrics(m *Metrics)
+}
+
+// Metrics gathers samples in the Prometheus text exposition format. Samples
+// of the same metric are written together whatever the order they are added
+// in, so that many collectors can report the same metrics.
+type Metrics struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name, help, kind string
+	samples          []string
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{byName: make(map[string]*metricFamily)}
+}
+
+func (m *Metrics) family(name, help, kind string) *metricFamily {
+	f := m.byName[name]
+	if f == nil {
+		f = &metricFamily{name: name, help: help, kind: kind}
+		m.byName[name] = f
+		m.families = append(m.families, f)
+	}
+	return f
+}
+
+// Counter adds a sample of a counter, labels are name and value pairs
+func (m *Metrics) Counter(name, help string, value float64, labels ...string) {
+	f := m.family(name, help, "counter")
+	f.samples = append(f.samples, formatSample(name, labels, value))
+}
+
+// Gauge adds a sample of a gauge, labels are name and value pairs
+func (m *Metrics) Gauge(name, help string, value float64, labels ...string) {
+	f := m.family(name, help, "gauge")
+	f.samples = append(f.samples, formatSample(name, labels, value))
+}
+
+// histogram adds the samples of h, labels are name and value pairs
+func (m *Metrics) histogram(name, help string, h *histogram, labels ...string) {
+	f := m.family(name, help, "histogram")
+	var cumulative int64
+	for i, n := range h.buckets {
+		cumulative += n
+		le := "+Inf"
+		if i < len(DownloadBuckets) {
+			le = strconv.FormatFloat(DownloadBuckets[i], 'g', -1, 64)
+		}
+		f.samples = append(f.samples, formatSample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", le), float64(cumulative)))
+	}
+	f.samples = append(f.samples,
+		formatSample(name+"_sum", labels, h.sum),
+		formatSample(name+"_count", labels, float64(h.count)))
+}
+
+// Write writes the samples in the text exposition format
+func (m *Metrics) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range m.families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.kind)
+		for _, s := range f.samples {
+			bw.WriteString(s)
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatSample(name string, labels []string, value float64) string {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	return b.String()
+}
+
+// MetricsHandler serves the metrics of collectors in the text exposition
+// format
+func MetricsHandler(collectors ...MetricsCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := NewMetrics()
+		for _, c := range collectors {
+			c.CollectMetrics(m)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.Write(w)
+	})
+}
+
+// collect adds the counters of st, prefix is the namespace of the side
+// counting them and labels identify the endpoint
+func (st *Stats) collect(m *Metrics, prefix string, labels ...string) {
+	with := func(extra ...string) []string {
+		return append(labels[:len(labels):len(labels)], extra...)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, command := range sortedKeys(st.requests) {
+		m.Counter(prefix+"_requests_total", "Download requests by command.",
+			float64(st.requests[command]), with("command", command)...)
+	}
+	for t := FrameUnknown; t <= FrameMSR; t++ {
+		if n, ok := st.framesSent[t]; ok {
+			m.Counter(prefix+"_frames_sent_total", "Frames sent by type.", float64(n), with("type", t.String())...)
+		}
+	}
+	for t := FrameUnknown; t <= FrameMSR; t++ {
+		if n, ok := st.framesReceived[t]; ok {
+			m.Counter(prefix+"_frames_received_total", "Frames received by type, invalid ones included.", float64(n), with("type", t.String())...)
+		}
+	}
+	m.Counter(prefix+"_checksum_failures_total", "Frames received with a bad checksum.", float64(st.ChecksumFailures.Load()), labels...)
+	m.Counter(prefix+"_naks_sent_total", "NAKs sent.", float64(st.NAKsSent.Load()), labels...)
+	m.Counter(prefix+"_naks_received_total", "NAKs received.", float64(st.NAKsReceived.Load()), labels...)
+	m.Counter(prefix+"_retransmissions_total", "Frames sent again after a NAK.", float64(st.Retransmissions.Load()), labels...)
+
+	keys := make([]downloadKey, 0, len(st.downloads))
+	for k := range st.downloads {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].command != keys[j].command {
+			return keys[i].command < keys[j].command
+		}
+		return keys[i].result < keys[j].result
+	})
+	for _, k := range keys {
+		m.histogram(prefix+"_download_duration_seconds", "Duration of downloads by command and result.",
+			st.downloads[k], with("command", k.command, "result", k.result)...)
+	}
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CollectMetrics implements MetricsCollector, samples are labelled with the
+// listen address
+func (s *Server) CollectMetrics(m *Metrics) {
+	s.mu.Lock()
+	active := len(s.Connections)
+	s.mu.Unlock()
+
+	m.Gauge("fakelpm_server_connections", "Connections currently open.", float64(active), "listener", s.Addr)
+	s.Stats.collect(m, "fakelpm_server", "listener", s.Addr)
+	m.Counter("fakelpm_server_ack_timeouts_total", "Frames the client did not acknowledge in time.",
+		float64(s.Stats.Timeouts.Load()), "listener", s.Addr)
+	m.Counter("fakelpm_server_auth_rejects_total", "Requests refused for unknown codes.",
+		float64(s.Stats.AuthRejects.Load()), "listener", s.Addr)
+}
+
+// CollectMetrics implements MetricsCollector, samples are labelled with the
+// server address
+func (c *Client) CollectMetrics(m *Metrics) {
+	c.collect(m, c.ServerAddr)
+}
+
+func (c *Client) collect(m *Metrics, target string) {
+	c.Stats.collect(m, "fakelpm_client", "target", target)
+	m.Counter("fakelpm_client_frame_timeouts_total", "Frames the server did not send in time.",
+		float64(c.Stats.Timeouts.Load()), "target", target)
+	m.Counter("fakelpm_client_clock_skew_alerts_total", "Headers with a clock skew beyond the threshold.",
+		float64(c.Stats.ClockSkewAlerts.Load()), "target", target)
+	if skew, ok := c.ClockSkew(); ok {
+		m.Gauge("fakelpm_client_clock_skew_seconds", "Concentrator clock ahead of local time at the last Header.",
+			skew.Seconds(), "target", target)
+	}
+}
+
+// ServeMetrics serves the metrics of collectors on http://addr/metrics, it
+// returns only when the listener fails
+func ServeMetrics(addr string, collectors ...MetricsCollector) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler(collectors...))
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,328 @@
+package fakelpm
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Schedule is a dusk-to-dawn lighting schedule. Times are offsets from
+// midnight; the lamp is powered from Dusk to Dawn and dimmed to DimLevel
+// between DimStart and DimEnd.
+type Schedule struct {
+	Dusk     time.Duration
+	Dawn     time.Duration
+	DimStart time.Duration
+	DimEnd   time.Duration
+	DimLevel float64 // 0-1 fraction of full power
+}
+
+func DefaultSchedule() Schedule {
+	return Schedule{
+		Dusk:     19 * time.Hour,
+		Dawn:     7 * time.Hour,
+		DimStart: 23 * time.Hour,
+		DimEnd:   5 * time.Hour,
+		DimLevel: 0.5,
+	}
+}
+
+// inWindow reports whether tod falls between from and to, wrapping at midnight
+func inWindow(tod, from, to time.Duration) bool {
+	if from <= to {
+		return tod >= from && tod < to
+	}
+	return tod >= from || tod < to
+}
+
+// Level returns the power level (0-1) required at t
+func (s Schedule) Level(t time.Time) float64 {
+	y, m, d := t.Date()
+	tod := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	if !inWindow(tod, s.Dusk, s.Dawn) {
+		return 0
+	}
+	if s.DimLevel > 0 && inWindow(tod, s.DimStart, s.DimEnd) {
+		return s.DimLevel
+	}
+	return 1
+}
+
+// Pole is a simulated lamp. Nominal values are at full power, the cumulative
+// counters start from the values set at creation.
+type Pole struct {
+	Address  int
+	Voltage  float64 // V
+	Current  float64 // A
+	Cosfi    float64
+	Schedule Schedule
+
+	// FaultProbability gives for each fault flag the chance of it being
+	// reported in a single reading. NotResponding is the chance of a lamp
+	// missing a whole night.
+	FaultProbability map[LampFlags]float64
+	NotResponding    float64
+
+	// ForcedFaults are reported in every reading on top of the random ones,
+	// ForcedNotResponding makes the lamp miss every night
+	ForcedFaults        LampFlags
+	ForcedNotResponding bool
+
+	Powered time.Duration
+	Lit     time.Duration
+	Energy  float64 // Wh
+
+	updated time.Time
+	dark    bool // lamp off because of a fault reported at the last reading
+}
+
+// HarvestTimes are the offsets from noon the readings of a night are taken at
+var HarvestTimes = [3]time.Duration{8 * time.Hour, 12 * time.Hour, 16 * time.Hour}
+
+// simStep is the resolution the cumulative counters are integrated with
+const simStep = time.Minute
+
+// Plant is a simulated set of poles producing a Data block per pole every
+// night
+type Plant struct {
+	Code      string
+	Location  *time.Location
+	SWVersion [4]byte // reported in the Header block
+
+	mu    sync.Mutex
+	poles []*Pole
+	rng   *rand.Rand
+	next  time.Time // noon starting the next night to simulate
+	start time.Time
+}
+
+// DefaultSWVersion is the concentrator firmware version of a new Plant
+var DefaultSWVersion = [4]byte{0x01, 0x02, 0x03, 0x04}
+
+// NewPlant creates a plant with n poles, numbered from 1, simulated from
+// start on. rng is only used under the plant lock, so it must not be shared.
+func NewPlant(code string, n int, start time.Time, rng *rand.Rand) *Plant {
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	p := &Plant{
+		Code:      code,
+		Location:  start.Location(),
+		SWVersion: DefaultSWVersion,
+		rng:       rng,
+		start:     start,
+		next:      nightOf(start),
+	}
+	for i := 1; i <= n; i++ {
+		p.AddPole(p.RandomPole(i))
+	}
+	return p
+}
+
+// nightOf returns the noon starting the night t belongs to
+func nightOf(t time.Time) time.Time {
+	t = t.Add(-12 * time.Hour)
+	return blockBase(t.Year(), t.Month(), t.Day(), t.Location())
+}
+
+// RandomPole returns a pole with plausible nominal values and counters
+func (p *Plant) RandomPole(address int) *Pole {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	powered := time.Duration(p.rng.Intn(20000)) * time.Hour
+	return &Pole{
+		Address:  address,
+		Voltage:  225 + p.rng.Float64()*10,
+		Current:  0.2 + p.rng.Float64()*0.6,
+		Cosfi:    0.85 + p.rng.Float64()*0.14,
+		Schedule: DefaultSchedule(),
+		FaultProbability: map[LampFlags]float64{
+			PowerSupplyUndervoltage:   0.01,
+			PowerSupplyOvervoltage:    0.01,
+			PowerSupplyOutputLimiter:  0.005,
+			PowerSupplyTermalDerating: 0.005,
+			LedPlateOpenCircuit:       0.002,
+			LedPlateThermalDerating:   0.005,
+			LedPlateThermalShutdown:   0.002,
+		},
+		NotResponding: 0.01,
+		Powered:       powered,
+		Lit:           time.Duration(float64(powered) * 0.98),
+		Energy:        float64(p.rng.Intn(2000000)),
+	}
+}
+
+// AddPole adds a pole to the plant, replacing any pole with the same address
+func (p *Plant) AddPole(pole *Pole) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pole.updated.IsZero() {
+		pole.updated = p.start
+	}
+	for i, other := range p.poles {
+		if other.Address == pole.Address {
+			p.poles[i] = pole
+			return
+		}
+	}
+	p.poles = append(p.poles, pole)
+}
+
+// RemovePole removes a pole, reporting whether it existed
+func (p *Plant) RemovePole(address int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, pole := range p.poles {
+		if pole.Address == address {
+			p.poles = append(p.poles[:i], p.poles[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ForceFaults sets the faults reported by a pole from its next reading on,
+// reporting whether the pole exists. Zero values restore random faults only.
+func (p *Plant) ForceFaults(address int, faults LampFlags, notResponding bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pole := range p.poles {
+		if pole.Address == address {
+			pole.ForcedFaults = faults & LampFaults
+			pole.ForcedNotResponding = notResponding
+			return true
+		}
+	}
+	return false
+}
+
+// Poles returns the current poles of the plant
+func (p *Plant) Poles() []*Pole {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Pole(nil), p.poles...)
+}
+
+// Advance simulates the plant up to now and returns the Data blocks of every
+// night completed in the meantime
+func (p *Plant) Advance(now time.Time) [][48]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now = now.In(p.Location)
+	var blocks [][48]byte
+	for !p.next.Add(HarvestTimes[2]).After(now) {
+		for _, pole := range p.poles {
+			blocks = append(blocks, p.simulateNight(pole, p.next)...)
+		}
+		p.next = p.next.AddDate(0, 0, 1)
+	}
+	return blocks
+}
+
+// simulateNight produces the readings of a pole for the night starting at base
+func (p *Plant) simulateNight(pole *Pole, base time.Time) [][48]byte {
+	if pole.ForcedNotResponding || p.rng.Float64() < pole.NotResponding {
+		p.integrate(pole, base.Add(HarvestTimes[2]))
+		return p.encode(pole, []LampReading{{
+			Address:       pole.Address,
+			Timestamp:     base,
+			Status:        BlockAcquired,
+			NotResponding: true,
+		}})
+	}
+
+	var readings []LampReading
+	for idx, offset := range HarvestTimes {
+		t := base.Add(offset)
+		if !t.After(pole.updated) {
+			continue
+		}
+		p.integrate(pole, t)
+		readings = append(readings, p.reading(pole, t, idx))
+	}
+	if len(readings) == 0 {
+		return nil
+	}
+
+	status := BlockAcquired
+	if len(readings) == len(HarvestTimes) {
+		status |= BlockComplete | BlockFinal
+	}
+	for i := range readings {
+		readings[i].Status = status
+	}
+	return p.encode(pole, readings)
+}
+
+func (p *Plant) encode(pole *Pole, readings []LampReading) [][48]byte {
+	blocks, err := EncodeLampBlocks(readings)
+	if err != nil {
+		log.Printf("Plant %s: dropping readings of pole %d: %v", p.Code, pole.Address, err)
+	}
+	return blocks
+}
+
+// integrate updates the cumulative counters of a pole up to t
+func (p *Plant) integrate(pole *Pole, t time.Time) {
+	for ts := pole.updated; ts.Before(t); ts = ts.Add(simStep) {
+		level := pole.Schedule.Level(ts)
+		if level == 0 {
+			continue
+		}
+		pole.Powered += simStep
+		if pole.dark {
+			continue
+		}
+		pole.Lit += simStep
+		pole.Energy += pole.Voltage * pole.Current * level * pole.Cosfi * simStep.Hours()
+	}
+	pole.updated = t
+}
+
+// reading returns the measure taken on a pole at t, idx is the harvest slot
+func (p *Plant) reading(pole *Pole, t time.Time, idx int) LampReading {
+	r := LampReading{
+		Address:        pole.Address,
+		Timestamp:      t,
+		MeasureType:    MeasureTypeEnergy,
+		ConversionType: 1,
+		Voltage:        math.Round(pole.Voltage * (0.98 + p.rng.Float64()*0.04)),
+	}
+
+	for flag := LampFlags(1); flag != 0; flag <<= 1 {
+		if p.rng.Float64() < pole.FaultProbability[flag] {
+			r.Flags |= flag
+		}
+	}
+	r.Flags |= pole.ForcedFaults & LampFaults
+
+	pole.dark = r.Flags.Has(LedPlateOpenCircuit) || r.Flags.Has(LedPlateThermalShutdown)
+	level := pole.Schedule.Level(t)
+	if level > 0 && !pole.dark {
+		r.Flags |= LampPowerOn
+		r.Current = pole.Current * level * (0.97 + p.rng.Float64()*0.06)
+		r.Cosfi = pole.Cosfi
+		if level < 1 {
+			// Drivers run with a worse power factor when dimmed
+			r.Cosfi -= 0.05
+		}
+		r.ActivePower = r.Voltage * r.Current * r.Cosfi
+	}
+
+	if idx == 0 {
+		r.HasEnergy = true
+		r.Energy = math.Round(pole.Energy)
+	} else {
+		r.HasDurations = true
+		r.Powered = pole.Powered
+		r.Lit = pole.Lit
+	}
+	return r
+}
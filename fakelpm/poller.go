@@ -0,0 +1,335 @@
+package fakelpm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for a Poller
+const (
+	DefaultPollInterval    = 15 * time.Minute
+	DefaultPollConcurrency = 8
+	DefaultPollJitter      = 0.1
+	DefaultMinBackoff      = 10 * time.Second
+	DefaultMaxBackoff      = 10 * time.Minute
+)
+
+// Target is a concentrator polled by a Poller
+type Target struct {
+	Name      string   `json:"name,omitempty"` // Addr when empty
+	Addr      string   `json:"addr"`
+	UserCode  string   `json:"user,omitempty"`
+	PlantCode string   `json:"plant,omitempty"`
+	Interval  Duration `json:"interval,omitempty"` // DefaultPollInterval when 0
+	// Location is the IANA time zone of the concentrator, used to decode
+	// block timestamps; the local zone when empty
+	Location string `json:"location,omitempty"`
+	// SkewThreshold is the clock skew beyond which an alert is raised,
+	// DefaultSkewThreshold when unset; with CorrectSkew the timestamps of
+	// readings are corrected by a skew beyond it
+	SkewThreshold *Duration `json:"skew_threshold,omitempty"`
+	CorrectSkew   bool      `json:"correct_skew,omitempty"`
+}
+
+// TargetList is the content of a poller targets file
+type TargetList struct {
+	Targets []Target `json:"targets"`
+}
+
+// LoadTargets reads a JSON targets file
+func LoadTargets(path string) ([]Target, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list TargetList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid targets file %s: %v", path, err)
+	}
+	return list.Targets, nil
+}
+
+// Record is a lamp reading downloaded from a concentrator
+type Record struct {
+	Target    string    `json:"target"`
+	UserCode  string    `json:"user"`
+	PlantCode string    `json:"plant"`
+	Received  time.Time `json:"received"`
+	// ClockSkew is the concentrator clock skew the timestamp was corrected
+	// by, 0 when it was not
+	ClockSkew time.Duration `json:"clock_skew,omitempty"`
+	LampReading
+}
+
+// Sink receives the records decoded from each downloaded block. A block is
+// acknowledged to the concentrator only once Write returns without error.
+type Sink interface {
+	Write(ctx context.Context, records []Record) error
+}
+
+// SinkFunc adapts a function to the Sink interface
+type SinkFunc func(ctx context.Context, records []Record) error
+
+func (f SinkFunc) Write(ctx context.Context, records []Record) error {
+	return f(ctx, records)
+}
+
+// Poller runs DP downloads from a set of concentrators, each on its own
+// interval, and hands the records to a Sink. Polls are spread by a random
+// jitter, at most Concurrency of them run at once, and a failing target is
+// retried with an exponential backoff. An interrupted download is resumed by
+// the next poll of the same target.
+type Poller struct {
+	Targets []Target
+	Sink    Sink
+
+	Concurrency int
+	// Jitter is the fraction of the interval each poll is randomly moved by
+	Jitter     float64
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Configure, when set, is called on the client of every target before
+	// its first poll
+	Configure func(t Target, c *Client)
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	targets []*pollTarget
+}
+
+func NewPoller(targets []Target, sink Sink) *Poller {
+	return &Poller{
+		Targets:     targets,
+		Sink:        sink,
+		Concurrency: DefaultPollConcurrency,
+		Jitter:      DefaultPollJitter,
+		MinBackoff:  DefaultMinBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// pollTarget is the running state of a Target
+type pollTarget struct {
+	Target
+	client *Client
+
+	polls    atomic.Int64
+	failures atomic.Int64
+	records  atomic.Int64
+	active   atomic.Bool
+}
+
+// Run polls the targets until ctx is done
+func (p *Poller) Run(ctx context.Context) error {
+	if p.Sink == nil {
+		return fmt.Errorf("poller has no sink")
+	}
+
+	targets := make([]*pollTarget, 0, len(p.Targets))
+	for i, t := range p.Targets {
+		pt, err := p.prepare(t)
+		if err != nil {
+			return fmt.Errorf("target %d: %v", i, err)
+		}
+		targets = append(targets, pt)
+	}
+	p.mu.Lock()
+	p.targets = targets
+	p.mu.Unlock()
+
+	sem := make(chan struct{}, max(p.Concurrency, 1))
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.run(ctx, t, sem)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (p *Poller) prepare(t Target) (*pollTarget, error) {
+	if t.Addr == "" {
+		return nil, fmt.Errorf("missing address")
+	}
+	if t.Name == "" {
+		t.Name = t.Addr
+	}
+	if t.Interval <= 0 {
+		t.Interval = Duration(DefaultPollInterval)
+	}
+
+	loc := time.Local
+	if t.Location != "" {
+		var err error
+		if loc, err = time.LoadLocation(t.Location); err != nil {
+			return nil, fmt.Errorf("%s: %v", t.Name, err)
+		}
+	}
+
+	c := NewClient(t.Addr)
+	if err := c.SetUserCode(t.UserCode); err != nil {
+		return nil, fmt.Errorf("%s: %v", t.Name, err)
+	}
+	if err := c.SetPlantCode(t.PlantCode); err != nil {
+		return nil, fmt.Errorf("%s: %v", t.Name, err)
+	}
+	c.SetLocation(loc)
+	if p.Configure != nil {
+		p.Configure(t, c)
+	}
+	if t.SkewThreshold != nil {
+		c.SetSkewThreshold(time.Duration(*t.SkewThreshold))
+	}
+	if t.CorrectSkew {
+		c.SetCorrectSkew(true)
+	}
+	return &pollTarget{Target: t, client: c}, nil
+}
+
+// run is the schedule of a single target
+func (p *Poller) run(ctx context.Context, t *pollTarget, sem chan struct{}) {
+	interval := time.Duration(t.Interval)
+	// Spread the first polls of all targets
+	delay := time.Duration(p.random() * p.Jitter * float64(interval))
+	failures := 0
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case sem <- struct{}{}:
+		}
+		t.active.Store(true)
+		n, err := p.poll(ctx, t)
+		t.active.Store(false)
+		<-sem
+
+		if ctx.Err() != nil {
+			return
+		}
+		t.polls.Add(1)
+		t.records.Add(int64(n))
+		if err != nil {
+			t.failures.Add(1)
+			failures++
+			delay = p.backoff(failures)
+			log.Printf("Poll of %s failed (%d in a row), retrying in %s: %v", t.Name, failures, delay.Round(time.Millisecond), err)
+		} else {
+			failures = 0
+			delay = p.spread(interval)
+			log.Printf("Polled %s: %d records, next poll in %s", t.Name, n, delay.Round(time.Millisecond))
+		}
+		timer.Reset(delay)
+	}
+}
+
+// poll runs a single DP download, or resumes the last one if it was
+// interrupted, and returns the number of records written to the sink
+func (p *Poller) poll(ctx context.Context, t *pollTarget) (int, error) {
+	c := t.client
+	if err := c.ConnectContext(ctx); err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	n := 0
+	handle := func(m *Measurement) error {
+		records, err := c.Records(t.Name, m)
+		if err != nil {
+			// Refusing the block would stall the target forever
+			log.Printf("Poll of %s: skipping undecodable block: %v", t.Name, err)
+			return nil
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		if err := p.Sink.Write(ctx, records); err != nil {
+			return fmt.Errorf("sink: %v", err)
+		}
+		n += len(records)
+		return nil
+	}
+
+	var err error
+	if c.Interrupted() {
+		log.Printf("Resuming interrupted download from %s", t.Name)
+		_, err = c.Resume(ctx, handle)
+	} else {
+		_, err = c.Download(ctx, false, handle)
+	}
+	return n, err
+}
+
+// spread returns d moved by a random jitter
+func (p *Poller) spread(d time.Duration) time.Duration {
+	return d + time.Duration((2*p.random()-1)*p.Jitter*float64(d))
+}
+
+// backoff returns the wait before the next attempt after failures polls in a
+// row failed
+func (p *Poller) backoff(failures int) time.Duration {
+	d := max(p.MinBackoff, time.Millisecond)
+	for i := 1; i < failures && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 {
+		d = min(d, p.MaxBackoff)
+	}
+	return p.spread(d)
+}
+
+func (p *Poller) random() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rng == nil {
+		p.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return p.rng.Float64()
+}
+
+// CollectMetrics implements MetricsCollector, reporting the polls and the
+// client counters of every target labelled with its name
+func (p *Poller) CollectMetrics(m *Metrics) {
+	p.mu.Lock()
+	targets := p.targets
+	p.mu.Unlock()
+
+	active := 0
+	for _, t := range targets {
+		if t.active.Load() {
+			active++
+		}
+	}
+	m.Gauge("fakelpm_poller_targets", "Concentrators polled.", float64(len(targets)))
+	m.Gauge("fakelpm_poller_polls_active", "Polls currently running.", float64(active))
+	for _, t := range targets {
+		failures := t.failures.Load()
+		m.Counter("fakelpm_poller_polls_total", "Polls by target and result.",
+			float64(t.polls.Load()-failures), "target", t.Name, "result", "ok")
+		m.Counter("fakelpm_poller_polls_total", "Polls by target and result.",
+			float64(failures), "target", t.Name, "result", "failed")
+		m.Counter("fakelpm_poller_records_total", "Records written to the sink by target.",
+			float64(t.records.Load()), "target", t.Name)
+		t.client.collect(m, t.Name)
+	}
+}
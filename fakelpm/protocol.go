@@ -2,13 +2,10 @@ package fakelpm
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"math/rand"
-	"strconv"
 	"time"
 )
 
@@ -25,6 +22,21 @@ const (
 	FinalMsgType       = "D4EOD"
 )
 
+// Block select bits of a Request, only measures are emulated
+const (
+	BlockSelMeasures byte = 0x08 // D4 measurement blocks
+)
+
+// Request flags carried in the Reserved byte, an extension of the emulator
+const (
+	// RequestResume asks to continue an interrupted download of the same
+	// command after the last block the client acknowledged
+	RequestResume byte = 0x01
+)
+
+// ErrChecksum is wrapped by the errors of frames failing checksum validation
+var ErrChecksum = errors.New("invalid checksum")
+
 // 22 bytes
 type Request struct {
 	STX       byte    // [0] Start of transmission (0x02)
@@ -154,7 +166,6 @@ const (
 	LPM_lamp_address_tag                          = "lamp_address"
 )
 
-// DecodeHistoricalMeasures decodes the base64 encoded historical measures
 // <---DECODE BASE64--->
 
 // Helper function to convert bool to float64
@@ -165,536 +176,122 @@ func btof(b bool) float64 {
 	return 0.0
 }
 
-// Helper function to check if pair is FFFE
-func checkPairOn(high, low byte) bool {
-	return high == 0xFF && low == 0xFE
-}
-
-// Helper function to check if pair is not FFFF
-func checkPairOff(high, low byte) bool {
-	return !(high == 0xFF && low == 0xFF)
-}
-
-// Helper function to safely get float values from the map
-func getFloat(m map[string]interface{}, key string) float64 {
-	if val, ok := m[key]; ok {
-		if f, ok := val.(float64); ok {
-			return f
-		}
-	}
-	return 0.0
-}
-
-// EncodeMeasurements encodes measurements back to the original base64 format
+// EncodeHistoricalMeasures encodes measurements in map form back to the
+// original base64 format, see LampReadingFromMap and EncodeLampReadings
 func EncodeHistoricalMeasures(measurements []map[string]interface{}) (string, error) {
-	// First ensure all measurements have the required lamp_address field
-	// by checking for either lamp_address or pole
+	readings := make([]LampReading, 0, len(measurements))
 	for i, m := range measurements {
-		// Try to get lamp_address from either field
-		var lampAddr interface{}
-		var ok bool
-
-		// First try LPM_lamp_address_tag
-		if lampAddr, ok = m[LPM_lamp_address_tag]; !ok {
-			// Fall back to "pole" if available
-			if lampAddr, ok = m["pole"]; !ok {
-				return "", fmt.Errorf("measurement %d missing both lamp_address and pole fields", i)
-			}
-		}
-
-		// Ensure we have a timestamp
-		if _, ok := m["timestamp"]; !ok {
-			return "", fmt.Errorf("measurement %d missing timestamp", i)
-		}
-
-		// Normalize to use LPM_lamp_address_tag
-		m[LPM_lamp_address_tag] = lampAddr
-	}
-
-	// Rest of the function remains the same as previous version
-	// Group measurements by their lamp_address and date (YYYYMMDD)
-	blocks := make(map[string][]map[string]interface{})
-
-	for _, m := range measurements {
-		lampAddr := int(m[LPM_lamp_address_tag].(float64))
-		timestamp := m["timestamp"].(time.Time)
-		dateKey := fmt.Sprintf("%d_%04d%02d%02d", lampAddr, timestamp.Year(), timestamp.Month(), timestamp.Day())
-
-		blocks[dateKey] = append(blocks[dateKey], m)
-	}
-
-	var binaryData bytes.Buffer
-	binaryData.Write([]byte("D4")) // Write header
-
-	for _, block := range blocks {
-		// We need exactly 3 measurements per block - pad if necessary
-		for len(block) < 3 {
-			if len(block) > 0 {
-				block = append(block, block[len(block)-1])
-			} else {
-				// Create empty measurement if block is empty
-				emptyMeas := make(map[string]interface{})
-				emptyMeas[LPM_lamp_address_tag] = 0.0
-				emptyMeas["timestamp"] = time.Now()
-				// Initialize all other fields to 0
-				emptyMeas[LPM_lamp_measure_lamp_power_on] = 0.0
-				emptyMeas[LPM_lamp_measure_power_supply_undervoltage] = 0.0
-				emptyMeas[LPM_lamp_measure_power_supply_overvoltage] = 0.0
-				emptyMeas[LPM_lamp_measure_power_supply_output_limiter] = 0.0
-				emptyMeas[LPM_lamp_measure_power_supply_termal_derating] = 0.0
-				emptyMeas[LPM_lamp_measure_led_plate_open_circuit] = 0.0
-				emptyMeas[LPM_lamp_measure_led_plate_thermal_derating] = 0.0
-				emptyMeas[LPM_lamp_measure_led_plate_thermal_shutdown] = 0.0
-				emptyMeas[LPM_lamp_measure_voltage] = 0.0
-				emptyMeas[LPM_lamp_measure_current] = 0.0
-				emptyMeas[LPM_lamp_measure_cosfi] = 0.0
-				emptyMeas[LPM_lamp_measure_time_lamp_powered] = 0.0
-				emptyMeas[LPM_lamp_measure_time_lamp_poweron] = 0.0
-				block = append(block, emptyMeas)
-			}
-		}
-
-		var blockBytes [48]byte
-
-		// Use first measurement for common fields
-		first := block[0]
-		timestamp := first["timestamp"].(time.Time)
-		lampAddr := int(first[LPM_lamp_address_tag].(float64))
-
-		// Status and year
-		year := timestamp.Year()
-		blockBytes[0] = byte((year >> 8) & 0x1F) // High bits of year in status
-		blockBytes[1] = byte(year & 0xFF)        // Low byte of year
-
-		// Month and day (BCD encoded)
-		blockBytes[2] = byteToBCD(byte(timestamp.Month()))
-		blockBytes[3] = byteToBCD(byte(timestamp.Day()))
-
-		// Lamp address (little-endian)
-		blockBytes[4] = byte(lampAddr & 0xFF)
-		blockBytes[5] = byte((lampAddr >> 8) & 0xFF)
-
-		// Measurement type (default to 0)
-		blockBytes[6] = 0
-
-		// Process each of the 3 measurements
-		for idx, measurement := range block[:3] {
-			offset := 7 + idx*11
-			timeOffset := idx * 2
-
-			// Lamp status
-			var status byte
-			if getFloat(measurement, LPM_lamp_measure_lamp_power_on) == 1 {
-				status |= 0x01
-			}
-			if getFloat(measurement, LPM_lamp_measure_power_supply_undervoltage) == 1 {
-				status |= 0x02
-			}
-			if getFloat(measurement, LPM_lamp_measure_power_supply_overvoltage) == 1 {
-				status |= 0x04
-			}
-			if getFloat(measurement, LPM_lamp_measure_power_supply_output_limiter) == 1 {
-				status |= 0x08
-			}
-			if getFloat(measurement, LPM_lamp_measure_power_supply_termal_derating) == 1 {
-				status |= 0x10
-			}
-			if getFloat(measurement, LPM_lamp_measure_led_plate_open_circuit) == 1 {
-				status |= 0x20
-			}
-			if getFloat(measurement, LPM_lamp_measure_led_plate_thermal_derating) == 1 {
-				status |= 0x40
-			}
-			if getFloat(measurement, LPM_lamp_measure_led_plate_thermal_shutdown) == 1 {
-				status |= 0x80
-			}
-			blockBytes[offset] = status
-
-			// Voltage (little-endian)
-			voltage := uint16(getFloat(measurement, LPM_lamp_measure_voltage))
-			blockBytes[offset+1] = byte(voltage & 0xFF)
-			blockBytes[offset+2] = byte(voltage >> 8)
-
-			// Current (convert back to original units)
-			current := uint16(getFloat(measurement, LPM_lamp_measure_current) * 1000 / 3.57)
-			blockBytes[offset+3] = byte(current & 0xFF)
-			blockBytes[offset+4] = byte(current >> 8)
-
-			// Time durations (convert back to original units)
-			powered := uint16(getFloat(measurement, LPM_lamp_measure_time_lamp_powered) / 154.3)
-			blockBytes[offset+5] = byte(powered & 0xFF)
-			blockBytes[offset+6] = byte(powered >> 8)
-
-			lit := uint16(getFloat(measurement, LPM_lamp_measure_time_lamp_poweron) / 154.3)
-			blockBytes[offset+7] = byte(lit & 0xFF)
-			blockBytes[offset+8] = byte(lit >> 8)
-
-			// Power factor
-			cosfi := getFloat(measurement, LPM_lamp_measure_cosfi)
-			absCosfi := cosfi
-			if cosfi < 0 {
-				absCosfi = -cosfi
-			}
-			blockBytes[offset+9] = byte(absCosfi * 100)
-			if cosfi < 0 {
-				blockBytes[offset+10] = 0x01
-			} else {
-				blockBytes[offset+10] = 0x00
-			}
-
-			// Harvest time (minutes from noon)
-			if ts, ok := measurement["timestamp"].(time.Time); ok {
-				minutes := int(ts.Sub(
-					time.Date(
-						timestamp.Year(),
-						timestamp.Month(),
-						timestamp.Day(),
-						12, 0, 0, 0,
-						timestamp.Location(),
-					),
-				).Minutes())
-				blockBytes[40+timeOffset] = byte(minutes & 0xFF)
-				blockBytes[41+timeOffset] = byte(minutes >> 8)
-			}
+		r, err := LampReadingFromMap(m)
+		if err != nil {
+			return "", fmt.Errorf("measurement %d: %v", i, err)
 		}
-
-		// Conversion type and reserved
-		blockBytes[46] = 0
-		blockBytes[47] = 0
-
-		binaryData.Write(blockBytes[:])
-	}
-
-	rawData := binaryData.Bytes()
-	if len(rawData) < 2 || string(rawData[:2]) != "D4" {
-		return "", fmt.Errorf("invalid data header")
+		readings = append(readings, r)
 	}
-
-	// Convert binary data (after D4 header) to hex string
-	hexData := make([]byte, hex.EncodedLen(len(rawData[2:])))
-	hex.Encode(hexData, rawData[2:])
-
-	// Combine D4 header with hex data
-	finalData := append([]byte("D4"), hexData...)
-
-	// Then base64 encode
-	return base64.StdEncoding.EncodeToString(finalData), nil
+	return EncodeLampReadings(readings)
 }
 
+// DecodeMeasures decodes every sample in SampleMeasurements in the map form
+// of the original sample decoder, see measureMap
 func (s *Server) DecodeMeasures() ([]map[string]interface{}, error) {
 	var results []map[string]interface{}
 
 	for _, sample := range SampleMeasurements {
-		data, err := base64.StdEncoding.DecodeString(sample)
+		readings, err := DecodeLampReadings(sample, s.Location)
 		if err != nil {
-			return nil, fmt.Errorf("base64 decode failed: %v", err)
+			return nil, err
 		}
-
-		if len(data) < 2 || string(data[:2]) != "D4" {
-			continue
-		}
-		measurementData := data[2:]
-
-		if len(measurementData)%48 != 0 {
-			return nil, fmt.Errorf("invalid data length: %d bytes (not divisible by 48)", len(measurementData))
-		}
-
-		for i := 0; i < len(measurementData)/48; i++ {
-			block := measurementData[i*48 : (i*48)+48]
-			blockResults, err := parseMeasurementBlock(block, s.Location)
-			if err != nil {
-				return nil, err
-			}
-			results = append(results, blockResults...)
+		for _, r := range readings {
+			results = append(results, measureMap(r))
 		}
 	}
 
 	return results, nil
 }
 
-func parseMeasurementBlock(block []byte, loc *time.Location) ([]map[string]interface{}, error) {
-	var results []map[string]interface{}
-
-	data := Data{}
-	if err := binary.Read(bytes.NewReader(block), binary.LittleEndian, &data); err != nil {
-		return nil, fmt.Errorf("failed to parse data block: %v", err)
-	}
-
-	// Extract common fields
-	year := 2000 + int(data.Year)
-	month := time.Month(data.Month)
-	day := int(data.Day)
-	pole := binary.LittleEndian.Uint16([]byte{data.PoleLow, data.PoleHigh})
-
-	// Process each of the 3 measurements
-	measurements := []struct {
-		state       byte
-		tension     [2]byte
-		current     [2]byte
-		powered     [2]byte
-		lit         [2]byte
-		cosfi       [2]byte
-		harvestTime [2]byte
-	}{
-		{data.M1LampState, data.M1Tension, data.M1Current, data.M1PoweredDuration, data.M1LitDuration, data.M1Cosfi, [2]byte{data.HarvestTimes[0], data.HarvestTimes[1]}},
-		{data.M2LampState, data.M2Tension, data.M2Current, data.M2PoweredDuration, data.M2LitDuration, data.M2Cosfi, [2]byte{data.HarvestTimes[2], data.HarvestTimes[3]}},
-		{data.M3LampState, data.M3Tension, data.M3Current, data.M3PoweredDuration, data.M3LitDuration, data.M3Cosfi, [2]byte{data.HarvestTimes[4], data.HarvestTimes[5]}},
-	}
-
-	for _, m := range measurements {
-		result := make(map[string]interface{})
-
-		// Timestamp calculation
-		harvestMinutes := int(binary.LittleEndian.Uint16(m.harvestTime[:]))
-		measureTime := time.Date(
-			year,
-			month,
-			day,
-			12, 0, 0, 0, // Noon as base time
-			loc,
-		).Add(time.Minute * time.Duration(harvestMinutes))
-
-		// Electrical measurements
-		voltage := binary.LittleEndian.Uint16(m.tension[:])
-		current := float64(binary.LittleEndian.Uint16(m.current[:])) * 3.57 / 1000
-
-		// Power factor
-		cosfi := float64(m.cosfi[0]) / 100
-		if m.cosfi[1]&1 == 1 {
-			cosfi *= -1
-		}
-		power := float64(voltage) * current * cosfi
-
-		// Lamp state
-		lampOn := m.state&1 == 1
-		powerSupplyUndervoltage := m.state&2 == 1
-		powerSupplyOvervoltage := m.state&4 == 1
-		powerSupplyOutputLimiter := m.state&8 == 1
-		powerSupplyTermalDerating := m.state&16 == 1
-		ledPlateOpenCircuit := m.state&32 == 1
-		ledPlateThermalDerating := m.state&64 == 1
-		ledPlateThermalShutdown := m.state&128 == 1
-
-		// Time durations
-		poweredDuration := float64(binary.LittleEndian.Uint16(m.powered[:])) * 154.3
-		litDuration := float64(binary.LittleEndian.Uint16(m.lit[:])) * 154.3
-
-		// Build result map
-		result["timestamp"] = measureTime
-		result["pole"] = pole
-		result["voltage"] = float64(voltage)
-		result["current"] = current
-		result["power"] = power
-		result["cosfi"] = cosfi
-		result["lamp_on"] = lampOn
-		result["power_supply_undervoltage"] = powerSupplyUndervoltage
-		result["power_supply_overvoltage"] = powerSupplyOvervoltage
-		result["power_supply_output_limiter"] = powerSupplyOutputLimiter
-		result["power_supply_termal_derating"] = powerSupplyTermalDerating
-		result["led_plate_open_circuit"] = ledPlateOpenCircuit
-		result["led_plate_thermal_derating"] = ledPlateThermalDerating
-		result["led_plate_thermal_shutdown"] = ledPlateThermalShutdown
-		result["time_lamp_powered"] = poweredDuration
-		result["time_lamp_poweron"] = litDuration
-		result["measure_type"] = data.MeasureType
-		result["status"] = data.Status
-
-		results = append(results, result)
+// measureMap returns a reading in the map form of DecodeMeasures: the flags
+// are bools, lamp_power_on is named lamp_on, the address is a uint16 pole and
+// the signed power sits next to the block measure type, conversion type and
+// status
+func measureMap(r LampReading) map[string]interface{} {
+	m := map[string]interface{}{
+		"timestamp":       r.Timestamp,
+		"pole":            uint16(r.Address),
+		"measure_type":    r.MeasureType,
+		"conversion_type": r.ConversionType,
+		"status":          r.Status,
 	}
-
-	return results, nil
-}
-
-func DecodeHistoricalMeasures(base64Data string, loc *time.Location) ([]map[string]interface{}, error) {
-	var results []map[string]interface{}
-
-	// Decode from base64
-	data, err := base64.StdEncoding.DecodeString(base64Data)
-	if err != nil {
-		return nil, fmt.Errorf("base64 decode failed: %v", err)
+	if r.NotResponding {
+		m[LPM_lamp_measure_state_not_responding] = 1.0
+		return m
 	}
 
-	//log.Printf("Decoded to UTF-8: %s", string(data))
-
-	if len(data) < 2 || string(data[:2]) != "D4" {
-		return nil, fmt.Errorf("invalid data header, expected D4")
+	for i, name := range lampFlagNames {
+		if i == 0 {
+			name = "lamp_on"
+		}
+		m[name] = r.Flags&(1<<i) != 0
 	}
-	measurementData := data[2:] // Remove D4 header
-
-	//log.Printf("Decoded to UTF-8 (removed D4): %s", string(measurementData))
+	m["voltage"] = r.Voltage
+	m["current"] = r.Current
+	m["power"] = r.Voltage * r.Current * r.Cosfi
+	m["cosfi"] = r.Cosfi
 
-	// Verify length is multiple of 48*2 (since each byte is represented as 2 hex chars)
-	if len(measurementData)%(48*2) != 0 {
-		return nil, fmt.Errorf("invalid data length: %d bytes (not divisible by %d)", len(measurementData), 48*2)
+	if r.HasEnergy {
+		m[LPM_lamp_measure_energy] = r.Energy
 	}
+	if r.HasDurations {
+		m[LPM_lamp_measure_time_lamp_powered] = r.Powered.Seconds()
+		m[LPM_lamp_measure_time_lamp_poweron] = r.Lit.Seconds()
+	}
+	return m
+}
 
-	// Convert hex string to bytes
-	dst := make([]byte, hex.DecodedLen(len(measurementData)))
-	n, err := hex.Decode(dst, measurementData)
+// DecodeHistoricalMeasures decodes the base64 encoded historical measures in
+// the map form of the original decoder, see historicalMaps and
+// DecodeLampReadings for the typed form
+func DecodeHistoricalMeasures(base64Data string, loc *time.Location) ([]map[string]interface{}, error) {
+	raw, err := decodeHistoricalData(base64Data)
 	if err != nil {
-		return nil, fmt.Errorf("hex decode failed: %v", err)
+		return nil, err
 	}
-	dst = dst[:n]
-
-	// Process each 48-byte block
-	nBlocks := len(dst) / 48
-	for i := 0; i < nBlocks; i++ {
-		block := dst[i*48 : (i*48)+48]
-
-		// Extract basic information
-		status := block[0]
-		yearHigh := int16(status & 31)
-		yearLow := block[1]
-		year := int((yearHigh << 8)) + int(yearLow)
-
-		if year < 2000 || year > 2100 {
-			continue // Skip invalid years
-		}
-
-		month, err := strconv.Atoi(fmt.Sprintf("%x", block[2]))
-		if err != nil {
-			return nil, fmt.Errorf("invalid month: %v", err)
-		}
 
-		day, err := strconv.Atoi(fmt.Sprintf("%x", block[3]))
-		if err != nil {
-			return nil, fmt.Errorf("invalid day: %v", err)
-		}
-
-		// Lamp address is little-endian (byte 5 is high, byte 4 is low)
-		lampAddress := fmt.Sprintf("%02x%02x", block[5], block[4])
-		lampAddressInt, err := strconv.Atoi(lampAddress)
+	var results []map[string]interface{}
+	for i := 0; i < len(raw)/48; i++ {
+		b, err := decodeLampSlots(raw[i*48:(i+1)*48], loc)
 		if err != nil {
-			return nil, fmt.Errorf("invalid lamp address: %v", err)
-		}
-
-		measureType := fmt.Sprintf("%x", block[6])
-		scaleFactorValue := fmt.Sprintf("%x", block[46])
-
-		// Check alarm status
-		notifyAlarmNotResponding := false
-		alarmNotRespondingActive := false
-
-		if checkPairOn(block[41], block[40]) &&
-			checkPairOn(block[43], block[42]) &&
-			checkPairOn(block[45], block[44]) {
-			notifyAlarmNotResponding = true
-			alarmNotRespondingActive = true
+			return nil, err
 		}
+		results = append(results, historicalMaps(b)...)
+	}
+	return results, nil
+}
 
-		if !checkPairOff(block[41], block[40]) ||
-			!checkPairOff(block[43], block[42]) ||
-			!checkPairOff(block[45], block[44]) {
-			notifyAlarmNotResponding = true
-			alarmNotRespondingActive = false
-		}
+// historicalMaps returns the slots of a block in the map form of the
+// original decoder, which differs from LampReading.Map: a not responding
+// block yields nothing, the third slot carries state_not_responding 0 and
+// keeps only that and the lamp address when its state has no measure.
+func historicalMaps(b *lampBlock) []map[string]interface{} {
+	if b == nil || b.notResponding {
+		return nil
+	}
 
-		// Time scale factor
-		timeScaleFactor := 154.3
-		if scaleFactorValue == "1" {
-			timeScaleFactor = 60 * 60 * 1 // seconds in an hour
-		} else if scaleFactorValue == "2" {
-			timeScaleFactor = 60 * 60 * 2 // seconds in two hours
-		} else if scaleFactorValue == "3" {
-			timeScaleFactor = 60 * 60 * 3 // seconds in three hours
+	var results []map[string]interface{}
+	for idx, r := range b.slots {
+		var m map[string]interface{}
+		switch {
+		case r != nil:
+			m = r.Map()
+		case b.noMeasure[idx] && idx == 2:
+			m = map[string]interface{}{LPM_lamp_address_tag: float64(b.common.Address)}
+		default:
+			continue
 		}
-
-		// Process the 3 measurements in each block
-		for idx := 0; idx < 3; idx++ {
-			result := make(map[string]interface{})
-			offset := idx * 11
-			timeOffset := idx * 2
-
-			// Minutes from noon
-			measuresTime := int64(int64(block[41+timeOffset])<<8) + int64(block[40+timeOffset])
-			if measuresTime == 0xFFFF || measuresTime == 0xFFFE {
-				continue // Skip invalid measures
-			}
-
-			// Create timestamp
-			measureTime := time.Date(
-				year,
-				time.Month(month),
-				day,
-				12, 0, 0, 0, // Noon as base time
-				loc,
-			).Add(time.Minute * time.Duration(measuresTime))
-
-			// Lamp state
-			lampState := block[7+offset]
-			lampPowerOn := lampState&1 == 1
-			powerSupplyUndervoltage := lampState&2 == 1
-			powerSupplyOvervoltage := lampState&4 == 1
-			powerSupplyOutputLimiter := lampState&8 == 1
-			powerSupplyTermalDerating := lampState&16 == 1
-			ledPlateOpenCircuit := lampState&32 == 1
-			ledPlateThermalDerating := lampState&64 == 1
-			ledPlateThermalShutdown := lampState&128 == 1
-
-			// Electrical measurements
-			voltage := int64(int64(block[9+offset])<<8) + int64(block[8+offset])
-			current := float64(int64(int64(block[11+offset])<<8)+int64(block[10+offset])) * 3.57 / 1000
-			energyLow := int64(int64(block[13+offset])<<8) + int64(block[12+offset])
-			energyHigh := int64(int64(block[15+offset])<<8) + int64(block[14+offset])
-			energy := (energyHigh << 16) + energyLow
-			timeLampPowered := float64(int64(int64(block[13+offset])<<8)+int64(block[12+offset])) * timeScaleFactor
-			timeLampPoweron := float64(int64(int64(block[15+offset])<<8)+int64(block[14+offset])) * timeScaleFactor
-
-			// Power factor
-			cosfi := float64(int64(block[16+offset])) / 100.0
-			if (block[17+offset]&1) == 1 && cosfi != 0 {
-				cosfi *= -1.0
-			}
-
-			// Active power
-			activePower := cosfi * float64(voltage) * current
-			if activePower < 0 {
-				activePower *= -1.0
-			}
-
-			// Skip invalid states
-			if lampState != 0x28 && lampState != 0xF8 && lampState != 0xF1 {
-				result[LPM_lamp_measure_lamp_power_on] = btof(lampPowerOn)
-				result[LPM_lamp_measure_power_supply_undervoltage] = btof(powerSupplyUndervoltage)
-				result[LPM_lamp_measure_power_supply_overvoltage] = btof(powerSupplyOvervoltage)
-				result[LPM_lamp_measure_power_supply_output_limiter] = btof(powerSupplyOutputLimiter)
-				result[LPM_lamp_measure_power_supply_termal_derating] = btof(powerSupplyTermalDerating)
-				result[LPM_lamp_measure_led_plate_open_circuit] = btof(ledPlateOpenCircuit)
-				result[LPM_lamp_measure_led_plate_thermal_derating] = btof(ledPlateThermalDerating)
-				result[LPM_lamp_measure_led_plate_thermal_shutdown] = btof(ledPlateThermalShutdown)
-
-				result[LPM_lamp_measure_voltage] = float64(voltage)
-				result[LPM_lamp_measure_current] = current
-				result[LPM_lamp_measure_cosfi] = cosfi
-				result[LPM_lamp_measure_active_power] = activePower
-
-				if measureType == "7" && idx == 0 {
-					result[LPM_lamp_measure_energy] = float64(energy)
-				} else if measureType == "7" && idx > 0 {
-					result[LPM_lamp_measure_time_lamp_powered] = timeLampPowered
-					result[LPM_lamp_measure_time_lamp_poweron] = timeLampPoweron
-				}
-
-				result["timestamp"] = measureTime
-			}
-
-			// Add alarm status if needed
-			if idx == 2 && notifyAlarmNotResponding {
-				stateNotResponding := 0.0
-				if alarmNotRespondingActive {
-					stateNotResponding = 1.0
-				}
-				result[LPM_lamp_measure_state_not_responding] = stateNotResponding
-			}
-
-			if len(result) > 0 {
-				result[LPM_lamp_address_tag] = float64(lampAddressInt)
-				results = append(results, result)
-			}
+		if idx == 2 {
+			m[LPM_lamp_measure_state_not_responding] = 0.0
 		}
+		results = append(results, m)
 	}
-
-	return results, nil
+	return results
 }
 
 // <---DECODE BASE64--->
@@ -715,6 +312,35 @@ func NewRequest() Request {
 	}
 }
 
+// MaxRecords returns the maximum number of records requested, 0 means all.
+// The MaxRec field is a big-endian binary count.
+func (r *Request) MaxRecords() int {
+	return int(binary.BigEndian.Uint32(r.MaxRec[:]))
+}
+
+func (r *Request) SetMaxRecords(n int) {
+	binary.BigEndian.PutUint32(r.MaxRec[:], uint32(n))
+}
+
+// ParseCode converts a UserCode or PlantCode to its 4 byte request field,
+// shorter codes are padded with leading zeros
+func ParseCode(code string) ([4]byte, error) {
+	var b [4]byte
+	if len(code) > 4 {
+		return b, fmt.Errorf("code %q longer than 4 characters", code)
+	}
+	for i := range b {
+		b[i] = '0'
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] < 0x20 || code[i] > 0x7E {
+			return b, fmt.Errorf("code %q is not printable ASCII", code)
+		}
+	}
+	copy(b[4-len(code):], code)
+	return b, nil
+}
+
 func (r *Request) Bytes() []byte {
 	b := make([]byte, 22)
 	b[0] = r.STX
@@ -737,8 +363,8 @@ func ParseRequest(data []byte) (*Request, error) {
 		return nil, fmt.Errorf("STX not found")
 	}
 
-	// find ETX pos
-	etxPos := bytes.IndexByte(data, ETX)
+	// find ETX pos, searching from the end as binary fields may contain 0x03
+	etxPos := bytes.LastIndexByte(data, ETX)
 	if etxPos == -1 {
 		return nil, fmt.Errorf("ETX not found")
 	}
@@ -769,8 +395,9 @@ func ParseRequest(data []byte) (*Request, error) {
 	for _, b := range framedData[1:19] {
 		sum += uint16(b)
 	}
-	if binary.BigEndian.Uint16(req.Checksum[:]) != sum {
-		return nil, errors.New("invalid checksum")
+	receivedChecksum := binary.BigEndian.Uint16(req.Checksum[:])
+	if sum != receivedChecksum {
+		return nil, fmt.Errorf("%w (calculated: %d, received: %d)", ErrChecksum, sum, receivedChecksum)
 	}
 
 	return req, nil
@@ -818,7 +445,7 @@ func ParseHeader(data []byte) (*Header, error) {
 
 	receivedChecksum := binary.BigEndian.Uint16(data[32:34])
 	if sum != receivedChecksum {
-		return nil, fmt.Errorf("invalid checksum (calculated: %d, received: %d)", sum, receivedChecksum)
+		return nil, fmt.Errorf("%w (calculated: %d, received: %d)", ErrChecksum, sum, receivedChecksum)
 	}
 
 	// Parse the header
@@ -896,10 +523,20 @@ func NewMeasurement() *Measurement {
 	}
 }
 
+// NewRandomMeasurement returns a measurement with random content dated now
 func NewRandomMeasurement() *Measurement {
+	return NewRandomMeasurementAt(time.Now())
+}
+
+// NewRandomMeasurementAt returns a measurement with random content dated t,
+// see Server.RandomMeasurement for one dated by the server clock
+func NewRandomMeasurementAt(t time.Time) *Measurement {
+	return newRandomMeasurement(globalRand{}, t)
+}
+
+func newRandomMeasurement(rng randSource, now time.Time) *Measurement {
 	m := NewMeasurement()
-	now := time.Now()
-	randData := generateRandomData(now)
+	randData := generateRandomData(rng, now)
 	copy(m.Data[:], randData[:])
 	m.CalculateMeasurementChecksum()
 	return m
@@ -941,52 +578,65 @@ func ParseMeasurement(data []byte) (*Measurement, error) {
 	for _, b := range data[1:53] { // Sum from Computer to end of Data
 		sum += uint16(b)
 	}
-	if binary.BigEndian.Uint16(m.Checksum[:]) != sum {
-		return nil, errors.New("invalid checksum")
+	receivedChecksum := binary.BigEndian.Uint16(m.Checksum[:])
+	if sum != receivedChecksum {
+		return nil, fmt.Errorf("%w (calculated: %d, received: %d)", ErrChecksum, sum, receivedChecksum)
 	}
 
 	return m, nil
 }
 
-func generateRandomData(t time.Time) [48]byte {
+// randSource is the part of *rand.Rand used by the generators
+type randSource interface {
+	Intn(n int) int
+	Float32() float32
+}
+
+// globalRand forwards to the package level math/rand functions
+type globalRand struct{}
+
+func (globalRand) Intn(n int) int   { return rand.Intn(n) }
+func (globalRand) Float32() float32 { return rand.Float32() }
+
+func generateRandomData(rng randSource, t time.Time) [48]byte {
 	var d [48]byte
 
 	// Status and date
-	d[0] = generateStatusByte()
+	d[0] = generateStatusByte(rng)
 	d[1] = byte(t.Year() % 100)
 	d[2] = byteToBCD(byte(t.Month()))
 	d[3] = byteToBCD(byte(t.Day()))
 
 	// Pole number
-	pole := uint16(rand.Intn(10000))
+	pole := uint16(rng.Intn(10000))
 	binary.LittleEndian.PutUint16(d[4:6], pole)
 
 	// Measurement type
-	d[6] = byte(rand.Intn(2)) * 7 // 0 or 7
+	d[6] = byte(rng.Intn(2)) * 7 // 0 or 7
 
 	// Generate 3 measurements
 	for i := 0; i < 3; i++ {
 		offset := 7 + i*11
 
 		// Lamp state
-		d[offset] = generateLampStatus()
+		d[offset] = generateLampStatus(rng)
 
 		// Voltage (180-250V)
-		voltage := 18000 + rand.Intn(7000)
+		voltage := 18000 + rng.Intn(7000)
 		binary.LittleEndian.PutUint16(d[offset+1:offset+3], uint16(voltage))
 
 		// Current (0-5000 units of 3.47mA)
-		current := rand.Intn(5000)
+		current := rng.Intn(5000)
 		binary.LittleEndian.PutUint16(d[offset+3:offset+5], uint16(current))
 
 		// Durations
-		binary.LittleEndian.PutUint16(d[offset+5:offset+7], uint16(rand.Intn(65536)))
-		binary.LittleEndian.PutUint16(d[offset+7:offset+9], uint16(rand.Intn(65536)))
+		binary.LittleEndian.PutUint16(d[offset+5:offset+7], uint16(rng.Intn(65536)))
+		binary.LittleEndian.PutUint16(d[offset+7:offset+9], uint16(rng.Intn(65536)))
 
 		// Power factor
-		pf := byte(rand.Intn(101))
+		pf := byte(rng.Intn(101))
 		sign := byte(0)
-		if rand.Float32() < 0.1 {
+		if rng.Float32() < 0.1 {
 			sign = 1
 		}
 		d[offset+9] = pf
@@ -995,28 +645,28 @@ func generateRandomData(t time.Time) [48]byte {
 		// Harvest time
 		if i < 3 {
 			harvestOffset := 40 + i*2
-			minutes := rand.Intn(1440)
+			minutes := rng.Intn(1440)
 			binary.LittleEndian.PutUint16(d[harvestOffset:harvestOffset+2], uint16(minutes))
 		}
 	}
 
 	// Conversion type
-	d[46] = byte(rand.Intn(4))
+	d[46] = byte(rng.Intn(4))
 	d[47] = 0
 
 	return d
 }
 
 // generateStatusByte creates random status byte
-func generateStatusByte() byte {
+func generateStatusByte(rng randSource) byte {
 	var status byte
-	if rand.Float32() < 0.8 { // 80% chance of being acquired
+	if rng.Float32() < 0.8 { // 80% chance of being acquired
 		status |= 0x80
 	}
-	if rand.Float32() < 0.7 { // 70% chance of being complete
+	if rng.Float32() < 0.7 { // 70% chance of being complete
 		status |= 0x40
 	}
-	if rand.Float32() < 0.9 { // 90% chance of being final
+	if rng.Float32() < 0.9 { // 90% chance of being final
 		status |= 0x20
 	}
 	// Year bits (0-4) are handled separately
@@ -1024,54 +674,54 @@ func generateStatusByte() byte {
 }
 
 // generateLampStatus creates random lamp status byte
-func generateLampStatus() byte {
+func generateLampStatus(rng randSource) byte {
 	var status byte
-	if rand.Float32() < 0.8 { // 80% chance of being on
+	if rng.Float32() < 0.8 { // 80% chance of being on
 		status |= 0x01
 	}
 	// Random faults (each has 10% chance)
-	if rand.Float32() < 0.1 {
+	if rng.Float32() < 0.1 {
 		status |= 0x02 // Undervoltage
 	}
-	if rand.Float32() < 0.1 {
+	if rng.Float32() < 0.1 {
 		status |= 0x04 // Overvoltage
 	}
-	if rand.Float32() < 0.1 {
+	if rng.Float32() < 0.1 {
 		status |= 0x08 // Output limiter
 	}
-	if rand.Float32() < 0.1 {
+	if rng.Float32() < 0.1 {
 		status |= 0x10 // Thermal derating
 	}
-	if rand.Float32() < 0.1 {
+	if rng.Float32() < 0.1 {
 		status |= 0x20 // LED open circuit
 	}
-	if rand.Float32() < 0.1 {
+	if rng.Float32() < 0.1 {
 		status |= 0x40 // LED thermal derating
 	}
-	if rand.Float32() < 0.1 {
+	if rng.Float32() < 0.1 {
 		status |= 0x80 // LED thermal shutdown
 	}
 	return status
 }
 
 // generateAEMeasurements fills AE measurement data (10 bytes)
-func generateAEMeasurements(d []byte) {
+func generateAEMeasurements(rng randSource, d []byte) {
 	// Voltage (8-9) - 180-250V
-	voltage := 18000 + rand.Intn(7000) // 180.00V-250.00V
+	voltage := 18000 + rng.Intn(7000) // 180.00V-250.00V
 	binary.LittleEndian.PutUint16(d[0:2], uint16(voltage))
 
 	// Current (10-11) - 0-5000 (units of 3.47mA)
-	current := rand.Intn(5000)
+	current := rng.Intn(5000)
 	binary.LittleEndian.PutUint16(d[2:4], uint16(current))
 
 	// Powered duration (12-13) and lit duration (14-15) - 0-65535
-	binary.LittleEndian.PutUint16(d[4:6], uint16(rand.Intn(65536)))
-	binary.LittleEndian.PutUint16(d[6:8], uint16(rand.Intn(65536)))
+	binary.LittleEndian.PutUint16(d[4:6], uint16(rng.Intn(65536)))
+	binary.LittleEndian.PutUint16(d[6:8], uint16(rng.Intn(65536)))
 
 	// Power factor (16-17) - 0-100 with sign
-	pf := byte(rand.Intn(101))
+	pf := byte(rng.Intn(101))
 	sign := byte(0)
-	if rand.Float32() < 0.1 { // 10% chance of negative
+	if rng.Float32() < 0.1 { // 10% chance of negative
 		sign = 1
 	}
 	d[8] = pf
@@ -1079,26 +729,26 @@ func generateAEMeasurements(d []byte) {
 }
 
 // generateSingleMeasurement fills a single measurement (11 bytes)
-func generateSingleMeasurement(d []byte) {
+func generateSingleMeasurement(rng randSource, d []byte) {
 	// Lamp status (0)
-	d[0] = generateLampStatus()
+	d[0] = generateLampStatus(rng)
 
 	// Voltage (1-2) - 180-250V
-	voltage := 18000 + rand.Intn(7000) // 180.00V-250.00V
+	voltage := 18000 + rng.Intn(7000) // 180.00V-250.00V
 	binary.LittleEndian.PutUint16(d[1:3], uint16(voltage))
 
 	// Current (3-4) - 0-5000 (units of 3.47mA)
-	current := rand.Intn(5000)
+	current := rng.Intn(5000)
 	binary.LittleEndian.PutUint16(d[3:5], uint16(current))
 
 	// Powered duration (5-6) and lit duration (7-8) - 0-65535
-	binary.LittleEndian.PutUint16(d[5:7], uint16(rand.Intn(65536)))
-	binary.LittleEndian.PutUint16(d[7:9], uint16(rand.Intn(65536)))
+	binary.LittleEndian.PutUint16(d[5:7], uint16(rng.Intn(65536)))
+	binary.LittleEndian.PutUint16(d[7:9], uint16(rng.Intn(65536)))
 
 	// Power factor (9-10) - 0-100 with sign
-	pf := byte(rand.Intn(101))
+	pf := byte(rng.Intn(101))
 	sign := byte(0)
-	if rand.Float32() < 0.1 { // 10% chance of negative
+	if rng.Float32() < 0.1 { // 10% chance of negative
 		sign = 1
 	}
 	d[9] = pf
@@ -1106,16 +756,16 @@ func generateSingleMeasurement(d []byte) {
 }
 
 // generateHarvestTimes fills harvest times (6 bytes)
-func generateHarvestTimes(d []byte) {
+func generateHarvestTimes(rng randSource, d []byte) {
 	// Each harvest time is 2 bytes
 	for i := 0; i < 6; i += 2 {
 		// 10% chance of no measurement
-		if rand.Float32() < 0.1 {
+		if rng.Float32() < 0.1 {
 			d[i] = 0xFF
 			d[i+1] = 0xFF
 		} else {
 			// Random time in minutes from noon (0-1439)
-			minutes := rand.Intn(1440)
+			minutes := rng.Intn(1440)
 			binary.LittleEndian.PutUint16(d[i:i+2], uint16(minutes))
 		}
 	}
@@ -1192,8 +842,8 @@ func ParseFinal(data []byte) (*Final, error) {
 		return nil, fmt.Errorf("STX not found")
 	}
 
-	// find ETX pos
-	etxPos := bytes.IndexByte(data, ETX)
+	// find ETX pos, searching from the end as binary fields may contain 0x03
+	etxPos := bytes.LastIndexByte(data, ETX)
 	if etxPos == -1 {
 		return nil, fmt.Errorf("ETX not found")
 	}
@@ -1224,7 +874,7 @@ func ParseFinal(data []byte) (*Final, error) {
 
 	receivedChecksum := binary.BigEndian.Uint16(f.Checksum[:])
 	if sum != receivedChecksum {
-		return nil, fmt.Errorf("invalid checksum (calculated: %d, received: %d)", sum, receivedChecksum)
+		return nil, fmt.Errorf("%w (calculated: %d, received: %d)", ErrChecksum, sum, receivedChecksum)
 	}
 
 	return f, nil
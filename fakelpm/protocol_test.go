@@ -0,0 +1,123 @@
+package fakelpm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The lamp state of the first sample is 0x89: power on, output limiter and
+// LED plate thermal shutdown
+var sampleFlags = map[string]float64{
+	LPM_lamp_measure_lamp_power_on:                1,
+	LPM_lamp_measure_power_supply_undervoltage:    0,
+	LPM_lamp_measure_power_supply_overvoltage:     0,
+	LPM_lamp_measure_power_supply_output_limiter:  1,
+	LPM_lamp_measure_power_supply_termal_derating: 0,
+	LPM_lamp_measure_led_plate_open_circuit:       0,
+	LPM_lamp_measure_led_plate_thermal_derating:   0,
+	LPM_lamp_measure_led_plate_thermal_shutdown:   1,
+}
+
+func TestDecodeHistoricalMeasuresFlags(t *testing.T) {
+	results, err := DecodeHistoricalMeasures(SampleMeasurements[0], time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Fatal("no measures decoded")
+	}
+
+	for name, want := range sampleFlags {
+		if got := results[0][name]; got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestMeasureMapFlags(t *testing.T) {
+	tests := []struct {
+		state byte
+		want  map[string]bool
+	}{
+		{0x00, map[string]bool{"lamp_on": false, "power_supply_undervoltage": false, "led_plate_thermal_shutdown": false}},
+		{0x02, map[string]bool{"lamp_on": false, "power_supply_undervoltage": true, "power_supply_overvoltage": false}},
+		{0x89, map[string]bool{"lamp_on": true, "power_supply_output_limiter": true, "led_plate_thermal_shutdown": true, "led_plate_open_circuit": false}},
+		{0x70, map[string]bool{"power_supply_termal_derating": true, "led_plate_open_circuit": true, "led_plate_thermal_derating": true, "lamp_on": false}},
+	}
+
+	for _, tt := range tests {
+		m := measureMap(LampReading{Flags: LampFlags(tt.state)})
+		for name, want := range tt.want {
+			if got := m[name]; got != want {
+				t.Errorf("state %02X: %s = %v, want %v", tt.state, name, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeHistoricalMeasures(t *testing.T) {
+	var want []LampReading
+	var historical []map[string]interface{}
+	for _, sample := range SampleMeasurements {
+		readings, err := DecodeLampReadings(sample, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, readings...)
+
+		measures, err := DecodeHistoricalMeasures(sample, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		historical = append(historical, measures...)
+	}
+
+	server := &Server{Location: time.UTC}
+	measures, err := server.DecodeMeasures()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forms := []struct {
+		name     string
+		measures []map[string]interface{}
+		status   bool // the block status is part of the map form
+	}{
+		{"historical", historical, false},
+		{"server", measures, true},
+	}
+
+	for _, form := range forms {
+		t.Run(form.name, func(t *testing.T) {
+			encoded, err := EncodeHistoricalMeasures(form.measures)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := DecodeLampReadings(encoded, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !form.status {
+				for i := range got {
+					if i < len(want) {
+						got[i].Status = want[i].Status
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	malformed := []map[string]interface{}{
+		{LPM_lamp_address_tag: 625.0},
+		{LPM_lamp_address_tag: "625", "timestamp": time.Now()},
+	}
+	for _, m := range malformed {
+		if _, err := EncodeHistoricalMeasures([]map[string]interface{}{m}); err == nil {
+			t.Errorf("%v: no error", m)
+		}
+	}
+}
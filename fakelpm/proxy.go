@@ -0,0 +1,193 @@
+package fakelpm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Proxy forwards the connections it accepts to a concentrator, optionally
+// recording everything exchanged in a capture
+type Proxy struct {
+	Addr    string // listen address
+	Target  string // concentrator address
+	Capture *CaptureWriter
+
+	// DialTimeout bounds the connection to the target
+	DialTimeout time.Duration
+	// FirstConn is the number given to the first connection accepted, 1
+	// when 0. Set it past the connections of an appended capture.
+	FirstConn int
+	// OnFrame, when set, is called with every frame forwarded, or with the
+	// error of an invalid one. Frames are split from the byte stream of each
+	// direction, whatever the read boundaries.
+	OnFrame func(conn int, dir Direction, frame *Frame, err error)
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]bool
+	accepted int
+	stopChan chan struct{}
+}
+
+func NewProxy(addr, target string) *Proxy {
+	return &Proxy{
+		Addr:        addr,
+		Target:      target,
+		DialTimeout: DefaultDialTimeout,
+		conns:       make(map[net.Conn]bool),
+		stopChan:    make(chan struct{}),
+	}
+}
+
+// Start accepts connections until Stop is called
+func (p *Proxy) Start() error {
+	ln, err := net.Listen("tcp", p.Addr)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.ln = ln
+	p.mu.Unlock()
+	defer ln.Close()
+
+	log.Printf("Proxy listening on %s, forwarding to %s", p.Addr, p.Target)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-p.stopChan:
+				return nil
+			default:
+			}
+			log.Printf("Accept error: %v", err)
+			continue
+		}
+		go p.handleConnection(conn)
+	}
+}
+
+func (p *Proxy) Stop() {
+	close(p.stopChan)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ln != nil {
+		p.ln.Close()
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+}
+
+func (p *Proxy) track(conn net.Conn, add bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if add {
+		p.conns[conn] = true
+	} else {
+		delete(p.conns, conn)
+	}
+}
+
+func (p *Proxy) handleConnection(client net.Conn) {
+	defer client.Close()
+
+	p.mu.Lock()
+	id := max(p.FirstConn, 1) + p.accepted
+	p.accepted++
+	p.mu.Unlock()
+	log.Printf("Connection %d from %s", id, client.RemoteAddr())
+
+	server, err := net.DialTimeout("tcp", p.Target, p.DialTimeout)
+	if err != nil {
+		log.Printf("Connection %d: failed to reach %s: %v", id, p.Target, err)
+		return
+	}
+	defer server.Close()
+
+	p.track(client, true)
+	p.track(server, true)
+	defer p.track(client, false)
+	defer p.track(server, false)
+	p.record(CaptureEntry{Time: time.Now(), Conn: id, Event: CaptureOpen})
+
+	done := make(chan struct{}, 2)
+	go func() {
+		p.forward(id, ClientToServer, client, server)
+		done <- struct{}{}
+	}()
+	go func() {
+		p.forward(id, ServerToClient, server, client)
+		done <- struct{}{}
+	}()
+
+	// Either peer closing ends the session
+	<-done
+	client.Close()
+	server.Close()
+	<-done
+	log.Printf("Connection %d closed", id)
+}
+
+// forward copies src to dst, recording every read
+func (p *Proxy) forward(id int, dir Direction, src, dst net.Conn) {
+	var frames *io.PipeWriter
+	if p.OnFrame != nil {
+		pr, pw := io.Pipe()
+		frames = pw
+		defer pw.Close()
+		go p.split(id, dir, pr)
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			data := append([]byte(nil), buf[:n]...)
+			p.record(CaptureEntry{Time: time.Now(), Conn: id, Dir: dir, Data: data})
+			if _, werr := dst.Write(data); werr != nil {
+				return
+			}
+			if frames != nil {
+				frames.Write(data)
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				p.record(CaptureEntry{Time: time.Now(), Conn: id, Dir: dir, Event: CaptureClose})
+			}
+			return
+		}
+	}
+}
+
+// split reads the frames forwarded in one direction and passes them to
+// OnFrame
+func (p *Proxy) split(id int, dir Direction, r *io.PipeReader) {
+	defer r.Close()
+	fr := NewFrameReader(r)
+	for {
+		frame, err := fr.ReadFrame()
+		var ferr *FrameError
+		if err != nil && !errors.As(err, &ferr) {
+			if err == io.ErrUnexpectedEOF {
+				p.OnFrame(id, dir, nil, fmt.Errorf("connection closed in the middle of a frame"))
+			}
+			return
+		}
+		p.OnFrame(id, dir, frame, err)
+	}
+}
+
+func (p *Proxy) record(e CaptureEntry) {
+	if p.Capture == nil {
+		return
+	}
+	if err := p.Capture.Write(e); err != nil {
+		log.Printf("Connection %d: failed to write capture: %v", e.Conn, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"FakeLPM/fakelpm"
+)
+
+// tracer logs an annotated trace of the frames forwarded by the proxy
+type tracer struct {
+	mu   sync.Mutex
+	last map[int]time.Time // time of the last frame of each connection
+	loc  *time.Location
+	hex  bool
+}
+
+func (t *tracer) frame(conn int, dir fakelpm.Direction, frame *fakelpm.Frame, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var delta time.Duration
+	if last, ok := t.last[conn]; ok {
+		delta = now.Sub(last)
+	}
+	t.last[conn] = now
+
+	arrow := "client -> server"
+	if dir == fakelpm.ServerToClient {
+		arrow = "server -> client"
+	}
+
+	var text string
+	var raw []byte
+	switch ferr := err.(type) {
+	case nil:
+		text = fakelpm.DescribeFrame(frame, t.loc)
+		raw = frame.Raw
+	case *fakelpm.FrameError:
+		text = ferr.Error()
+		raw = ferr.Raw
+	default:
+		text = "ERROR " + err.Error()
+	}
+	if t.hex && raw != nil {
+		text += "\n    raw " + strings.ToUpper(fmt.Sprintf("%x", raw))
+	}
+	log.Printf("[%d] %s +%s %s", conn, arrow, delta.Round(time.Microsecond), text)
+}
+
+// Sniffing proxy: forwards a client to a concentrator and logs every frame
+// exchanged, decoded
+func main() {
+	listen := flag.String("listen", ":5002", "Address clients connect to")
+	target := flag.String("target", "localhost:5001", "Concentrator address")
+	location := flag.String("location", "", "IANA time zone of the concentrator, for block timestamps (local when empty)")
+	hexDump := flag.Bool("hex", false, "Also dump the raw bytes of every frame")
+	out := flag.String("out", "", "Capture file to record the sessions to, appended to")
+	flag.Parse()
+
+	loc := time.Local
+	if *location != "" {
+		var err error
+		if loc, err = time.LoadLocation(*location); err != nil {
+			log.Fatalf("Invalid location: %v", err)
+		}
+	}
+
+	proxy := fakelpm.NewProxy(*listen, *target)
+	t := &tracer{last: make(map[int]time.Time), loc: loc, hex: *hexDump}
+	proxy.OnFrame = t.frame
+	if *out != "" {
+		f, last, err := fakelpm.AppendCapture(*out)
+		if err != nil {
+			log.Fatalf("Failed to open capture: %v", err)
+		}
+		defer f.Close()
+		proxy.Capture = fakelpm.NewCaptureWriter(f)
+		proxy.FirstConn = last + 1
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		if err := proxy.Start(); err != nil {
+			log.Fatalf("Proxy failed: %v", err)
+		}
+	}()
+
+	<-sigChan
+	log.Println("Shutting down proxy...")
+	proxy.Stop()
+}
@@ -0,0 +1,659 @@
+package fakelpm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LampFlags is the lamp state byte of a single measurement
+type LampFlags byte
+
+const (
+	LampPowerOn LampFlags = 1 << iota
+	PowerSupplyUndervoltage
+	PowerSupplyOvervoltage
+	PowerSupplyOutputLimiter
+	PowerSupplyTermalDerating
+	LedPlateOpenCircuit
+	LedPlateThermalDerating
+	LedPlateThermalShutdown
+)
+
+// LampFaults masks every flag except the power on state
+const LampFaults = ^LampPowerOn
+
+var lampFlagNames = []string{
+	LPM_lamp_measure_lamp_power_on,
+	LPM_lamp_measure_power_supply_undervoltage,
+	LPM_lamp_measure_power_supply_overvoltage,
+	LPM_lamp_measure_power_supply_output_limiter,
+	LPM_lamp_measure_power_supply_termal_derating,
+	LPM_lamp_measure_led_plate_open_circuit,
+	LPM_lamp_measure_led_plate_thermal_derating,
+	LPM_lamp_measure_led_plate_thermal_shutdown,
+}
+
+func (f LampFlags) Has(flag LampFlags) bool {
+	return f&flag == flag
+}
+
+func (f LampFlags) String() string {
+	var names []string
+	for i, name := range lampFlagNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// Names returns the names of the flags set, as used in the map form
+func (f LampFlags) Names() []string {
+	names := []string{}
+	for i, name := range lampFlagNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ParseLampFlags returns the flags with the given names, as used in the map
+// form
+func ParseLampFlags(names []string) (LampFlags, error) {
+	var f LampFlags
+	for _, name := range names {
+		i := slices.Index(lampFlagNames, name)
+		if i < 0 {
+			return 0, fmt.Errorf("unknown lamp flag %q", name)
+		}
+		f |= 1 << i
+	}
+	return f, nil
+}
+
+// Block status bits, stored in the top of the first Data byte next to the
+// high bits of the year
+const (
+	BlockAcquired byte = 0x80
+	BlockComplete byte = 0x40
+	BlockFinal    byte = 0x20
+)
+
+// Special harvest time values
+const (
+	harvestEmpty         = 0xFFFF
+	harvestNotResponding = 0xFFFE
+)
+
+// Measure types found in byte 6 of a Data block
+const (
+	MeasureTypeBasic  byte = 0x00
+	MeasureTypeEnergy byte = 0x07 // first slot carries energy, the others durations
+)
+
+// LampReading is a single decoded lamp measurement. A Data block carries up
+// to three readings of the same lamp, taken on the night starting at noon of
+// the block date.
+type LampReading struct {
+	Address        int
+	Timestamp      time.Time
+	Status         byte // block status bits (BlockAcquired, ...)
+	MeasureType    byte
+	ConversionType byte
+
+	Flags       LampFlags
+	Voltage     float64 // V
+	Current     float64 // A
+	Cosfi       float64
+	ActivePower float64 // W
+
+	HasEnergy bool
+	Energy    float64
+
+	HasDurations bool
+	Powered      time.Duration
+	Lit          time.Duration
+
+	// NotResponding is set on the single reading produced for a block where
+	// the concentrator could not reach the lamp, no measure is available
+	NotResponding bool
+}
+
+// durationScale returns the seconds represented by one unit of the duration
+// fields for the given conversion type
+func durationScale(conversionType byte) float64 {
+	switch conversionType {
+	case 1:
+		return 60 * 60 * 1 // seconds in an hour
+	case 2:
+		return 60 * 60 * 2 // seconds in two hours
+	case 3:
+		return 60 * 60 * 3 // seconds in three hours
+	}
+	return 154.3
+}
+
+// conversionTypeOf returns the conversion type expressing the durations in
+// whole units, the finest one when several do, or the finest one they fit in
+func conversionTypeOf(durations ...time.Duration) byte {
+	types := []byte{0, 1, 2, 3}
+	fits := func(ct byte, exact bool) bool {
+		for _, d := range durations {
+			units := d.Seconds() / durationScale(ct)
+			if math.Round(units) > math.MaxUint16 || exact && math.Abs(units-math.Round(units)) > 1e-6 {
+				return false
+			}
+		}
+		return true
+	}
+	for _, exact := range []bool{true, false} {
+		for _, ct := range types {
+			if fits(ct, exact) {
+				return ct
+			}
+		}
+	}
+	return types[len(types)-1]
+}
+
+// blockBase returns the noon harvest times are counted from
+func blockBase(year int, month time.Month, day int, loc *time.Location) time.Time {
+	return time.Date(year, month, day, 12, 0, 0, 0, loc)
+}
+
+func bcdToInt(b byte) (int, error) {
+	hi, lo := int(b>>4), int(b&0x0F)
+	if hi > 9 || lo > 9 {
+		return 0, fmt.Errorf("invalid BCD value %02x", b)
+	}
+	return hi*10 + lo, nil
+}
+
+// DecodeLampBlock decodes a raw 48 byte Data block. Blocks with an
+// implausible year yield no readings.
+func DecodeLampBlock(block []byte, loc *time.Location) ([]LampReading, error) {
+	b, err := decodeLampSlots(block, loc)
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	if b.notResponding {
+		r := b.common
+		r.NotResponding = true
+		return []LampReading{r}, nil
+	}
+
+	var readings []LampReading
+	for _, r := range b.slots {
+		if r != nil {
+			readings = append(readings, *r)
+		}
+	}
+	return readings, nil
+}
+
+// lampBlock is a Data block decoded slot by slot
+type lampBlock struct {
+	common        LampReading // fields shared by the slots, dated at the block base
+	notResponding bool        // every slot is marked not responding
+
+	// slots holds the reading of every slot with a measure, noMeasure marks
+	// the slots with a harvest time but a lamp state without measure
+	slots     [3]*LampReading
+	noMeasure [3]bool
+}
+
+// decodeLampSlots decodes a raw 48 byte Data block, nil when its year is
+// implausible
+func decodeLampSlots(block []byte, loc *time.Location) (*lampBlock, error) {
+	if len(block) != 48 {
+		return nil, fmt.Errorf("invalid data block length: %d bytes, expected 48", len(block))
+	}
+
+	// Year is split between the low 5 bits of status and byte 1
+	status := block[0]
+	year := int(status&0x1F)<<8 + int(block[1])
+	if year < 2000 || year > 2100 {
+		return nil, nil
+	}
+
+	month, err := bcdToInt(block[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid month: %v", err)
+	}
+	day, err := bcdToInt(block[3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid day: %v", err)
+	}
+
+	// Lamp address is BCD, byte 5 is high, byte 4 is low
+	addrHigh, err := bcdToInt(block[5])
+	if err != nil {
+		return nil, fmt.Errorf("invalid lamp address: %v", err)
+	}
+	addrLow, err := bcdToInt(block[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid lamp address: %v", err)
+	}
+
+	base := blockBase(year, time.Month(month), day, loc)
+	b := &lampBlock{
+		common: LampReading{
+			Address:        addrHigh*100 + addrLow,
+			Timestamp:      base,
+			Status:         status &^ 0x1F,
+			MeasureType:    block[6],
+			ConversionType: block[46],
+		},
+		notResponding: true,
+	}
+	for idx := 0; idx < 3; idx++ {
+		if binary.LittleEndian.Uint16(block[40+idx*2:]) != harvestNotResponding {
+			b.notResponding = false
+		}
+	}
+	if b.notResponding {
+		return b, nil
+	}
+
+	scale := durationScale(b.common.ConversionType)
+	for idx := 0; idx < 3; idx++ {
+		slot := block[7+idx*11 : 18+idx*11]
+
+		// Minutes from noon
+		harvest := binary.LittleEndian.Uint16(block[40+idx*2:])
+		if harvest == harvestEmpty || harvest == harvestNotResponding {
+			continue
+		}
+
+		// States the concentrator uses for slots without a valid measure
+		if slot[0] == 0x28 || slot[0] == 0xF8 || slot[0] == 0xF1 {
+			b.noMeasure[idx] = true
+			continue
+		}
+
+		r := b.common
+		r.Timestamp = base.Add(time.Minute * time.Duration(harvest))
+		r.Flags = LampFlags(slot[0])
+		r.Voltage = float64(binary.LittleEndian.Uint16(slot[1:3]))
+		r.Current = float64(binary.LittleEndian.Uint16(slot[3:5])) * 3.57 / 1000
+
+		r.Cosfi = float64(slot[9]) / 100
+		if slot[10]&1 == 1 && r.Cosfi != 0 {
+			r.Cosfi *= -1
+		}
+		r.ActivePower = math.Abs(r.Cosfi * r.Voltage * r.Current)
+
+		if r.MeasureType == MeasureTypeEnergy {
+			low := binary.LittleEndian.Uint16(slot[5:7])
+			high := binary.LittleEndian.Uint16(slot[7:9])
+			if idx == 0 {
+				r.HasEnergy = true
+				r.Energy = float64(uint32(high)<<16 | uint32(low))
+			} else {
+				r.HasDurations = true
+				r.Powered = time.Duration(float64(low) * scale * float64(time.Second))
+				r.Lit = time.Duration(float64(high) * scale * float64(time.Second))
+			}
+		}
+
+		b.slots[idx] = &r
+	}
+
+	return b, nil
+}
+
+// DecodeLampReadings decodes the base64 historical measures format: "D4"
+// followed by the hex encoding of consecutive 48 byte Data blocks
+func DecodeLampReadings(base64Data string, loc *time.Location) ([]LampReading, error) {
+	raw, err := decodeHistoricalData(base64Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var readings []LampReading
+	for i := 0; i < len(raw)/48; i++ {
+		blockReadings, err := DecodeLampBlock(raw[i*48:(i+1)*48], loc)
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %v", i, err)
+		}
+		readings = append(readings, blockReadings...)
+	}
+
+	return readings, nil
+}
+
+// decodeHistoricalData returns the Data blocks of the base64 historical
+// measures format
+func decodeHistoricalData(base64Data string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(base64Data)
+	if err != nil {
+		return nil, fmt.Errorf("base64 decode failed: %v", err)
+	}
+
+	if len(data) < 2 || string(data[:2]) != MeasurementMsgType {
+		return nil, fmt.Errorf("invalid data header, expected D4")
+	}
+	measurementData := data[2:]
+
+	// Each byte is represented as 2 hex chars
+	if len(measurementData)%(48*2) != 0 {
+		return nil, fmt.Errorf("invalid data length: %d bytes (not divisible by %d)", len(measurementData), 48*2)
+	}
+
+	raw := make([]byte, hex.DecodedLen(len(measurementData)))
+	if _, err := hex.Decode(raw, measurementData); err != nil {
+		return nil, fmt.Errorf("hex decode failed: %v", err)
+	}
+	return raw, nil
+}
+
+// EncodeLampBlocks packs readings into Data blocks. Readings of the same lamp
+// taken in the same noon-to-noon night share a block, three at most; blocks
+// are returned in order of first appearance.
+func EncodeLampBlocks(readings []LampReading) ([][48]byte, error) {
+	type blockKey struct {
+		address int
+		night   string
+	}
+
+	var chunks []*[3]*LampReading
+	filling := make(map[blockKey]*[3]*LampReading)
+	for i := range readings {
+		r := &readings[i]
+		if r.Address < 0 || r.Address > 9999 {
+			return nil, fmt.Errorf("reading %d: lamp address %d out of range", i, r.Address)
+		}
+		if r.Timestamp.IsZero() {
+			return nil, fmt.Errorf("reading %d: missing timestamp", i)
+		}
+
+		key := blockKey{r.Address, r.Timestamp.Add(-12 * time.Hour).Format("20060102")}
+		chunk, ok := filling[key]
+		slot := -1
+		if ok && !r.NotResponding {
+			slot = freeSlot(chunk, r)
+		}
+		if slot < 0 {
+			chunk = new([3]*LampReading)
+			chunks = append(chunks, chunk)
+			filling[key] = chunk
+			slot = freeSlot(chunk, r)
+		}
+		chunk[slot] = r
+	}
+
+	blocks := make([][48]byte, 0, len(chunks))
+	for _, chunk := range chunks {
+		block, err := encodeLampBlock(chunk)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+// freeSlot returns the slot r can take in a block, or -1 if it needs a new
+// one. Energy blocks keep the energy reading in the first slot.
+func freeSlot(chunk *[3]*LampReading, r *LampReading) int {
+	for _, other := range chunk {
+		if other != nil && (other.NotResponding || other.MeasureType != r.MeasureType || other.ConversionType != r.ConversionType) {
+			return -1
+		}
+	}
+
+	from, to := 0, 3
+	if r.MeasureType == MeasureTypeEnergy {
+		if r.HasEnergy {
+			to = 1
+		} else {
+			from = 1
+		}
+	}
+	for slot := from; slot < to; slot++ {
+		if chunk[slot] == nil {
+			return slot
+		}
+	}
+	return -1
+}
+
+// encodeLampBlock encodes the readings of the same lamp and night, unused
+// slots are marked with an empty harvest time
+func encodeLampBlock(readings *[3]*LampReading) ([48]byte, error) {
+	var block [48]byte
+
+	var first *LampReading
+	for _, r := range readings {
+		if r != nil {
+			first = r
+			break
+		}
+	}
+	ts := first.Timestamp.Add(-12 * time.Hour)
+	base := blockBase(ts.Year(), ts.Month(), ts.Day(), first.Timestamp.Location())
+
+	// Status and year
+	block[0] = first.Status&^0x1F | byte(base.Year()>>8)&0x1F
+	block[1] = byte(base.Year())
+
+	// Month and day (BCD encoded)
+	block[2] = byteToBCD(byte(base.Month()))
+	block[3] = byteToBCD(byte(base.Day()))
+
+	// Lamp address (BCD, low digits first)
+	block[4] = byteToBCD(byte(first.Address % 100))
+	block[5] = byteToBCD(byte(first.Address / 100))
+
+	block[6] = first.MeasureType
+	block[46] = first.ConversionType
+	block[47] = 0
+
+	for idx := 0; idx < 3; idx++ {
+		binary.LittleEndian.PutUint16(block[40+idx*2:], harvestEmpty)
+	}
+
+	if first.NotResponding {
+		for idx := 0; idx < 3; idx++ {
+			binary.LittleEndian.PutUint16(block[40+idx*2:], harvestNotResponding)
+		}
+		return block, nil
+	}
+
+	scale := durationScale(first.ConversionType)
+	for idx, r := range readings {
+		if r == nil {
+			continue
+		}
+		slot := block[7+idx*11 : 18+idx*11]
+
+		slot[0] = byte(r.Flags)
+		binary.LittleEndian.PutUint16(slot[1:3], uint16(math.Round(r.Voltage)))
+		binary.LittleEndian.PutUint16(slot[3:5], uint16(math.Round(r.Current*1000/3.57)))
+
+		switch {
+		case r.HasEnergy:
+			energy := uint32(math.Round(r.Energy))
+			binary.LittleEndian.PutUint16(slot[5:7], uint16(energy))
+			binary.LittleEndian.PutUint16(slot[7:9], uint16(energy>>16))
+		case r.HasDurations:
+			powered, lit := math.Round(r.Powered.Seconds()/scale), math.Round(r.Lit.Seconds()/scale)
+			if powered < 0 || powered > math.MaxUint16 || lit < 0 || lit > math.MaxUint16 {
+				return block, fmt.Errorf("lamp %d: durations %s and %s out of range for conversion type %d", r.Address, r.Powered, r.Lit, first.ConversionType)
+			}
+			binary.LittleEndian.PutUint16(slot[5:7], uint16(powered))
+			binary.LittleEndian.PutUint16(slot[7:9], uint16(lit))
+		}
+
+		slot[9] = byte(math.Round(math.Abs(r.Cosfi) * 100))
+		if r.Cosfi < 0 {
+			slot[10] = 0x01
+		}
+
+		minutes := math.Round(r.Timestamp.Sub(base).Minutes())
+		if minutes < 0 || minutes >= harvestNotResponding {
+			return block, fmt.Errorf("lamp %d: harvest time %s out of range", r.Address, r.Timestamp)
+		}
+		binary.LittleEndian.PutUint16(block[40+idx*2:], uint16(minutes))
+	}
+
+	return block, nil
+}
+
+// EncodeLampReadings encodes readings in the base64 historical measures format
+func EncodeLampReadings(readings []LampReading) (string, error) {
+	blocks, err := EncodeLampBlocks(readings)
+	if err != nil {
+		return "", err
+	}
+
+	var raw bytes.Buffer
+	for _, block := range blocks {
+		raw.Write(block[:])
+	}
+
+	// Concentrators send the hex payload in upper case
+	hexData := strings.ToUpper(hex.EncodeToString(raw.Bytes()))
+	finalData := append([]byte(MeasurementMsgType), hexData...)
+	return base64.StdEncoding.EncodeToString(finalData), nil
+}
+
+// Map returns the reading in the map form keyed by the LPM_lamp_measure_*
+// constants
+func (r LampReading) Map() map[string]interface{} {
+	m := make(map[string]interface{})
+	m[LPM_lamp_address_tag] = float64(r.Address)
+	m["timestamp"] = r.Timestamp
+
+	if r.NotResponding {
+		m[LPM_lamp_measure_state_not_responding] = 1.0
+		return m
+	}
+
+	for i, name := range lampFlagNames {
+		m[name] = btof(r.Flags&(1<<i) != 0)
+	}
+
+	m[LPM_lamp_measure_voltage] = r.Voltage
+	m[LPM_lamp_measure_current] = r.Current
+	m[LPM_lamp_measure_cosfi] = r.Cosfi
+	m[LPM_lamp_measure_active_power] = r.ActivePower
+
+	if r.HasEnergy {
+		m[LPM_lamp_measure_energy] = r.Energy
+	}
+	if r.HasDurations {
+		m[LPM_lamp_measure_time_lamp_powered] = r.Powered.Seconds()
+		m[LPM_lamp_measure_time_lamp_poweron] = r.Lit.Seconds()
+	}
+
+	return m
+}
+
+// LampReadingFromMap converts the map form back into a LampReading. The lamp
+// address can also be given as "pole", the flags as bools and lamp_power_on
+// as "lamp_on", like DecodeMeasures does. Without measure_type and
+// conversion_type keys, readings carrying energy or durations are tagged
+// with MeasureTypeEnergy and the conversion type fitting the durations.
+func LampReadingFromMap(m map[string]interface{}) (LampReading, error) {
+	var r LampReading
+
+	addr, ok := m[LPM_lamp_address_tag]
+	if !ok {
+		if addr, ok = m["pole"]; !ok {
+			return r, fmt.Errorf("missing both lamp_address and pole fields")
+		}
+	}
+	switch v := addr.(type) {
+	case float64:
+		r.Address = int(v)
+	case int:
+		r.Address = v
+	case uint16:
+		r.Address = int(v)
+	default:
+		return r, fmt.Errorf("invalid lamp address type %T", addr)
+	}
+
+	ts, ok := m["timestamp"].(time.Time)
+	if !ok {
+		return r, fmt.Errorf("missing timestamp")
+	}
+	r.Timestamp = ts
+
+	var err error
+	float := func(key string) float64 {
+		val, ok := m[key]
+		if !ok || err != nil {
+			return 0
+		}
+		switch v := val.(type) {
+		case float64:
+			return v
+		case bool:
+			return btof(v)
+		case byte:
+			return float64(v)
+		}
+		err = fmt.Errorf("invalid %s type %T", key, val)
+		return 0
+	}
+
+	// Block fields, absent from the historical map form
+	r.Status = byte(float("status"))
+	r.MeasureType = byte(float("measure_type"))
+	r.ConversionType = byte(float("conversion_type"))
+
+	if float(LPM_lamp_measure_state_not_responding) == 1 {
+		r.NotResponding = true
+		return r, err
+	}
+
+	for i, name := range lampFlagNames {
+		if _, ok := m[name]; !ok && i == 0 {
+			name = "lamp_on"
+		}
+		if float(name) == 1 {
+			r.Flags |= 1 << i
+		}
+	}
+	r.Voltage = float(LPM_lamp_measure_voltage)
+	r.Current = float(LPM_lamp_measure_current)
+	r.Cosfi = float(LPM_lamp_measure_cosfi)
+	if _, ok := m[LPM_lamp_measure_active_power]; ok {
+		r.ActivePower = float(LPM_lamp_measure_active_power)
+	} else {
+		r.ActivePower = math.Abs(float("power"))
+	}
+
+	if _, ok := m[LPM_lamp_measure_energy]; ok {
+		r.HasEnergy = true
+		r.Energy = float(LPM_lamp_measure_energy)
+	}
+	if _, ok := m[LPM_lamp_measure_time_lamp_powered]; ok {
+		r.HasDurations = true
+		r.Powered = time.Duration(float(LPM_lamp_measure_time_lamp_powered) * float64(time.Second))
+		r.Lit = time.Duration(float(LPM_lamp_measure_time_lamp_poweron) * float64(time.Second))
+		if _, ok := m["conversion_type"]; !ok {
+			r.ConversionType = conversionTypeOf(r.Powered, r.Lit)
+		}
+	}
+	if _, ok := m["measure_type"]; !ok && (r.HasEnergy || r.HasDurations) {
+		r.MeasureType = MeasureTypeEnergy
+	}
+
+	return r, err
+}
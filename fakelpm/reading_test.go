@@ -0,0 +1,142 @@
+package fakelpm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// sampleBlock returns the first Data block of the first sample
+func sampleBlock(t *testing.T) []byte {
+	t.Helper()
+	raw, err := decodeHistoricalData(SampleMeasurements[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw[:48]
+}
+
+func TestDecodeLampReadings(t *testing.T) {
+	readings, err := DecodeLampReadings(SampleMeasurements[0], time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := LampPowerOn | PowerSupplyOutputLimiter | LedPlateThermalShutdown
+	want := []struct {
+		address        int
+		timestamp      time.Time
+		voltage        float64
+		cosfi          float64
+		powered, lit   time.Duration
+		measureType    byte
+		conversionType byte
+	}{
+		{625, time.Date(2024, 11, 19, 1, 12, 0, 0, time.UTC), 242, -0.97, 28308 * time.Hour, 28001 * time.Hour, MeasureTypeEnergy, 1},
+		{626, time.Date(2024, 11, 19, 1, 12, 0, 0, time.UTC), 243, -0.89, 17959 * time.Hour, 17959 * time.Hour, MeasureTypeEnergy, 1},
+	}
+	if len(readings) != len(want) {
+		t.Fatalf("got %d readings, want %d", len(readings), len(want))
+	}
+
+	for i, w := range want {
+		r := readings[i]
+		if r.Address != w.address || !r.Timestamp.Equal(w.timestamp) {
+			t.Errorf("reading %d: lamp %d at %s, want lamp %d at %s", i, r.Address, r.Timestamp, w.address, w.timestamp)
+		}
+		if r.Flags != flags {
+			t.Errorf("reading %d: flags %s, want %s", i, r.Flags, flags)
+		}
+		if r.Voltage != w.voltage || r.Cosfi != w.cosfi {
+			t.Errorf("reading %d: %vV cosfi %v, want %vV cosfi %v", i, r.Voltage, r.Cosfi, w.voltage, w.cosfi)
+		}
+		if !r.HasDurations || r.Powered != w.powered || r.Lit != w.lit {
+			t.Errorf("reading %d: powered %s lit %s, want %s and %s", i, r.Powered, r.Lit, w.powered, w.lit)
+		}
+		if r.MeasureType != w.measureType || r.ConversionType != w.conversionType {
+			t.Errorf("reading %d: measure type %d conversion %d, want %d and %d", i, r.MeasureType, r.ConversionType, w.measureType, w.conversionType)
+		}
+		if r.Status != BlockAcquired || r.NotResponding || r.HasEnergy {
+			t.Errorf("reading %d: unexpected %+v", i, r)
+		}
+	}
+}
+
+func TestLampReadingsRoundTrip(t *testing.T) {
+	for i, sample := range SampleMeasurements {
+		readings, err := DecodeLampReadings(sample, time.UTC)
+		if err != nil {
+			t.Fatalf("sample %d: %v", i, err)
+		}
+
+		encoded, err := EncodeLampReadings(readings)
+		if err != nil {
+			t.Fatalf("sample %d: %v", i, err)
+		}
+		// Slots are packed on encoding, so compare the decoded readings
+		decoded, err := DecodeLampReadings(encoded, time.UTC)
+		if err != nil {
+			t.Fatalf("sample %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(decoded, readings) {
+			t.Errorf("sample %d: got %+v, want %+v", i, decoded, readings)
+		}
+	}
+}
+
+func TestDecodeLampBlock(t *testing.T) {
+	tests := []struct {
+		name     string
+		edit     func(b []byte) []byte
+		readings int
+		wantErr  bool
+	}{
+		{"sample", func(b []byte) []byte { return b }, 1, false},
+		{"short block", func(b []byte) []byte { return b[:47] }, 0, true},
+		{"implausible year", func(b []byte) []byte { b[0], b[1] = 0x80, 0x01; return b }, 0, false},
+		{"invalid month", func(b []byte) []byte { b[2] = 0x1A; return b }, 0, true},
+		{"invalid address", func(b []byte) []byte { b[5] = 0xF0; return b }, 0, true},
+		{"no measure state", func(b []byte) []byte { b[29] = 0x28; return b }, 0, false},
+		{"all slots", func(b []byte) []byte { b[40], b[41], b[42], b[43] = 0x10, 0x00, 0x20, 0x00; return b }, 3, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := tt.edit(append([]byte(nil), sampleBlock(t)...))
+			readings, err := DecodeLampBlock(block, time.UTC)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if len(readings) != tt.readings {
+				t.Fatalf("got %d readings, want %d", len(readings), tt.readings)
+			}
+		})
+	}
+}
+
+func TestLampBlockNotResponding(t *testing.T) {
+	block := sampleBlock(t)
+	for idx := 0; idx < 3; idx++ {
+		block[40+idx*2], block[41+idx*2] = 0xFE, 0xFF
+	}
+
+	readings, err := DecodeLampBlock(block, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 1 || !readings[0].NotResponding {
+		t.Fatalf("got %+v, want a single not responding reading", readings)
+	}
+
+	blocks, err := EncodeLampBlocks(readings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeLampBlock(blocks[0][:], time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, readings) {
+		t.Errorf("got %+v, want %+v", decoded, readings)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"FakeLPM/fakelpm"
+)
+
+// Recording proxy: forwards clients to a concentrator and writes everything
+// exchanged to a capture file, for the server to replay with -replay
+func main() {
+	listen := flag.String("listen", ":5002", "Address clients connect to")
+	target := flag.String("target", "localhost:5001", "Concentrator address")
+	out := flag.String("out", "capture.jsonl", "Capture file, appended to")
+	flag.Parse()
+
+	f, last, err := fakelpm.AppendCapture(*out)
+	if err != nil {
+		log.Fatalf("Failed to open capture: %v", err)
+	}
+	defer f.Close()
+
+	proxy := fakelpm.NewProxy(*listen, *target)
+	proxy.Capture = fakelpm.NewCaptureWriter(f)
+	proxy.FirstConn = last + 1
+	log.Printf("Recording to %s", *out)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		if err := proxy.Start(); err != nil {
+			log.Fatalf("Proxy failed: %v", err)
+		}
+	}()
+
+	<-sigChan
+	log.Println("Shutting down proxy...")
+	proxy.Stop()
+}
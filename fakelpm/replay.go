@@ -0,0 +1,93 @@
+package fakelpm
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// replay plays a captured session to conn in place of the emulation: the
+// bytes the concentrator sent are written exactly as captured, at the same
+// offsets from the start of the connection. Connections get the captured
+// sessions in turn. What the client sends is read and logged, but does not
+// change what is replayed.
+func (s *Server) replay(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.Connections, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	s.mu.Lock()
+	conns := s.Replay.Conns()
+	if len(conns) == 0 {
+		s.mu.Unlock()
+		log.Printf("Replay capture is empty, closing connection from %s", conn.RemoteAddr())
+		return
+	}
+	id := conns[s.replayed%len(conns)]
+	s.replayed++
+	s.mu.Unlock()
+
+	session := s.Replay.Session(id)
+	log.Printf("Replaying captured connection %d (%d entries) to %s", id, len(session), conn.RemoteAddr())
+
+	clientDone := make(chan struct{})
+	go func() {
+		defer close(clientDone)
+		fr := NewFrameReader(conn)
+		for {
+			frame, err := fr.ReadFrame()
+			var ferr *FrameError
+			if errors.As(err, &ferr) {
+				log.Printf("Replay: received %v", ferr)
+				continue
+			}
+			if err != nil {
+				return
+			}
+			log.Printf("Replay: received %s frame", frame.Type)
+		}
+	}()
+
+	start := time.Now()
+	var origin time.Time
+	for _, e := range session {
+		if origin.IsZero() {
+			origin = e.Time
+		}
+		if e.Dir != ServerToClient {
+			continue
+		}
+
+		if wait := e.Time.Sub(origin) - time.Since(start); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-clientDone:
+				log.Printf("Replay: client closed the connection")
+				return
+			case <-s.stopChan:
+				return
+			}
+		}
+
+		if e.Event == CaptureClose {
+			log.Printf("Replay: closing the connection as captured")
+			return
+		}
+		if _, err := conn.Write(e.Data); err != nil {
+			log.Printf("Replay: write failed: %v", err)
+			return
+		}
+	}
+
+	// The client closed the captured connection, wait for this one to do
+	// the same
+	select {
+	case <-clientDone:
+	case <-s.stopChan:
+	}
+	log.Printf("Replay of captured connection %d complete", id)
+}
@@ -1,12 +1,12 @@
 package fakelpm
 
 import (
-	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -18,20 +18,91 @@ type Server struct {
 	stopChan    chan struct{}
 	StartTime   time.Time
 	Location    *time.Location
+	History     HistoryStore
+	Clock       Clock
+
+	// Plant answers the requests whose PlantCode matches none of Plants,
+	// when set. Plants lets a single listener emulate many concentrators,
+	// routing requests by PlantCode.
+	Plant  *Plant
+	Plants map[string]*Plant
+
+	// Rand drives the random choices of the server, seed it for
+	// reproducible sessions. Plants draw from their own source as they
+	// are used under their own lock.
+	Rand *rand.Rand
+	// Step is added to the simulated clock on every download request
+	Step time.Duration
+	// Faults is applied to every accepted connection
+	Faults *FaultInjector
+	// Replay, when set, is played back to every client in place of the
+	// emulated concentrator
+	Replay   *Capture
+	replayed int
+
+	// AckTimeout bounds the wait for the client answer to each frame, a
+	// frame refused with a NAK is resent at most MaxRetries times
+	AckTimeout time.Duration
+	MaxRetries int
+	Stats      Stats
+
+	// Reject tells what is done with requests whose codes match none of
+	// the credentials set with SetCredentials
+	Reject      RejectAction
+	credentials map[Credential]bool
+
+	// sessions holds the last record acknowledged in every unfinished
+	// download, for a resume request to continue from
+	sessions map[sessionKey]uint64
+
+	// Admin is the listen address of the admin HTTP API (see AdminHandler),
+	// served from Start when set
+	Admin       string
+	adminServer *http.Server
+
+	listener net.Listener
 }
 
+// sessionKey identifies a download that can be resumed
+type sessionKey struct {
+	user    string
+	plant   string
+	command string
+}
+
+// Defaults for the transport settings of a Server
+const (
+	DefaultAckTimeout = 5 * time.Second
+	DefaultMaxRetries = 3
+)
+
+// Defaults for the simulated plant created by New
+const (
+	DefaultPoles       = 20
+	DefaultHistoryDays = 3
+)
+
 func New(addr string) (*Server, error) {
 	loc, err := detectTimezone()
 	if err != nil {
 		return nil, fmt.Errorf("timezone detection failed: %v", err)
 	}
 
+	now := time.Now().In(loc)
+	rng := rand.New(rand.NewSource(now.UnixNano()))
 	return &Server{
 		Addr:        addr,
 		Connections: make(map[net.Conn]bool),
 		stopChan:    make(chan struct{}),
-		StartTime:   time.Now().In(loc),
+		StartTime:   now,
 		Location:    loc,
+		History:     NewMemoryHistory(),
+		Clock:       NewSimClock(now, 1),
+		Plant:       NewPlant("0000", DefaultPoles, now.AddDate(0, 0, -DefaultHistoryDays), rand.New(rand.NewSource(rng.Int63()))),
+		Rand:        rng,
+		Faults:      NewFaultInjector(nil, nil),
+		AckTimeout:  DefaultAckTimeout,
+		MaxRetries:  DefaultMaxRetries,
 	}, nil
 }
 
@@ -40,10 +111,31 @@ func (s *Server) Start() error {
 	if err != nil {
 		return err
 	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Stop is called
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.listener = ln
+	s.mu.Unlock()
 	defer ln.Close()
 
 	log.Printf("Server started at %s", s.StartTime.Format(time.RFC3339))
-	log.Printf("Server listening on %s", s.Addr)
+	log.Printf("Server listening on %s", ln.Addr())
+
+	if s.Admin != "" {
+		s.mu.Lock()
+		s.adminServer = &http.Server{Addr: s.Admin, Handler: s.AdminHandler()}
+		admin := s.adminServer
+		s.mu.Unlock()
+		log.Printf("Admin API listening on %s", s.Admin)
+		go func() {
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Admin API failed: %v", err)
+			}
+		}()
+	}
 
 	for {
 		select {
@@ -52,16 +144,28 @@ func (s *Server) Start() error {
 		default:
 			conn, err := ln.Accept()
 			if err != nil {
+				select {
+				case <-s.stopChan:
+					// Stop closed the listener
+					return nil
+				default:
+				}
 				log.Printf("Accept error: %v", err)
 				continue
 			}
+			conn = s.Faults.Wrap(conn)
 
 			s.mu.Lock()
 			s.Connections[conn] = true
 			s.mu.Unlock()
 
+			if s.Replay != nil {
+				go s.replay(conn)
+				continue
+			}
+
 			// Send initial ACK on connection (Requirement 3)
-			if _, err := conn.Write(BuildACKResponse()); err != nil {
+			if err := s.write(conn, BuildACKResponse()); err != nil {
 				log.Printf("Failed to send initial ACK: %v", err)
 				conn.Close()
 				continue
@@ -78,162 +182,376 @@ func (s *Server) handleConnection(conn net.Conn) {
 		delete(s.Connections, conn)
 		s.mu.Unlock()
 		conn.Close()
-
-		loc, _ := time.LoadLocation("Europe/Rome")
-		results, err := DecodeHistoricalMeasures(SampleMeasurements[0], loc)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		for _, result := range results {
-			fmt.Printf("Measurement: %+v\n", result)
-		}
-
-		// Encode back to base64
-		encoded, err := EncodeHistoricalMeasures(results)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		fmt.Println("Original base64 string:", SampleMeasurements[0])
-		fmt.Println("Encoded data:", encoded)
 	}()
 
 	log.Printf("New connection from %s", conn.RemoteAddr())
 
-	buf := make([]byte, 2048)
+	fr := NewFrameReader(conn)
+	var next *Frame
 	for {
-		n, err := conn.Read(buf)
-		if err != nil {
-			log.Printf("Read error: %v", err)
-			return
+		frame := next
+		next = nil
+		if frame == nil {
+			var err error
+			frame, err = s.readFrame(fr)
+			if err != nil {
+				var ferr *FrameError
+				if errors.As(err, &ferr) {
+					log.Printf("Invalid %s frame: %v", ferr.Type, ferr.Err)
+					if err := s.nak(conn); err != nil {
+						log.Printf("Failed to send NAK: %v", err)
+					}
+					continue
+				}
+				log.Printf("Read error: %v", err)
+				return
+			}
 		}
 
-		req, err := ParseRequest(buf[:n])
-		if err != nil {
-			log.Printf("Invalid request: %v", err)
-			if bytes.Contains(buf[:n], []byte{STX}) && bytes.Contains(buf[:n], []byte{ETX}) {
-				if _, err := conn.Write(BuildNAKResponse()); err != nil {
-					log.Printf("Failed to send NAK: %v", err)
-				}
+		if frame.Type != FrameRequest {
+			log.Printf("Ignoring unexpected %s frame", frame.Type)
+			continue
+		}
+		req := frame.Request
+		s.Stats.countRequest(string(req.Command[:]))
+
+		if !s.authorized(req) {
+			s.Stats.AuthRejects.Add(1)
+			log.Printf("Rejecting %s request from %s: unknown user/plant %q/%q",
+				req.Command[:], conn.RemoteAddr(), req.UserCode[:], req.PlantCode[:])
+			if s.Reject == RejectClose {
+				return
+			}
+			if err := s.nak(conn); err != nil {
+				log.Printf("Failed to send NAK: %v", err)
 			}
 			continue
 		}
 
 		switch string(req.Command[:]) {
 		case "DT", "DP":
-			log.Printf("Received %s request - Measures download", string(req.Command[:]))
-			headerBytes := BuildHeaderResponse(s, req)
-			if _, err := conn.Write(headerBytes); err != nil {
-				log.Printf("Failed to send header: %v", err)
-				return
+			start := time.Now()
+			var err error
+			next, err = s.download(conn, fr, req)
+			result := "ok"
+			if err != nil {
+				result = "failed"
 			}
-			log.Printf("Sent Header block for %s request", string(req.Command[:]))
-
-			// Wait for client to acknowledge header
-			ackBuf := make([]byte, 11)
-			if _, err := conn.Read(ackBuf); err != nil {
-				log.Printf("Failed to read header ACK: %v", err)
+			s.Stats.countDownload(string(req.Command[:]), result, time.Since(start))
+			if err != nil {
+				log.Printf("%s download aborted: %v", string(req.Command[:]), err)
 				return
 			}
 
-			// Send measurements
-			numMeasurements := 3 + rand.Intn(8)
-			for i := 0; i < numMeasurements; i++ {
-				measurement := NewRandomMeasurement()
-				measurementBytes := measurementToBytes(measurement)
-				if _, err := conn.Write(measurementBytes); err != nil {
-					log.Printf("Failed to send measurement: %v", err)
-					return
-				}
-				log.Printf("Sent measurement %d/%d", i+1, numMeasurements)
-
-				// Wait for ACK with timeout
-				ackBuf := make([]byte, 11)
-				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-				n, err := conn.Read(ackBuf)
-				conn.SetReadDeadline(time.Time{})
-				if err != nil {
-					log.Printf("Failed to read measurement ACK: %v", err)
-					return
-				}
-				log.Printf("received session ACK: %q", ackBuf[:n])
+		default:
+			log.Printf("Unknown command: %s", req.Command[:])
+			if err := s.nak(conn); err != nil {
+				log.Printf("Failed to send NAK: %v", err)
 			}
+		}
+	}
+}
 
-			// Send final package
-			final := NewFinal()
-			final.CalculateFinalChecksum()
-			finalBytes := final.Bytes()
-			if _, err := conn.Write(finalBytes); err != nil {
-				log.Printf("Failed to send final package: %v", err)
-				return
+// download runs a DT or DP session. DT sends the whole plant history, DP only
+// the records after the client cursor; the cursor is moved past the records
+// sent once the client acknowledges the Final frame. A request flagged with
+// RequestResume continues an interrupted download of the same command after
+// the last block acknowledged in it. A frame received in place of the Final
+// acknowledgement is returned for the caller to handle.
+func (s *Server) download(conn net.Conn, fr *FrameReader, req *Request) (*Frame, error) {
+	command := string(req.Command[:])
+	log.Printf("Received %s request - Measures download", command)
+
+	p := s.plantFor(req)
+	if p == nil {
+		log.Printf("No plant %q on this server, refusing %s request", req.PlantCode[:], command)
+		if err := s.nak(conn); err != nil {
+			return nil, fmt.Errorf("failed to send NAK: %v", err)
+		}
+		return nil, nil
+	}
+	user, plant := string(req.UserCode[:]), p.Code
+
+	if err := s.produce(p); err != nil {
+		return nil, fmt.Errorf("failed to update history: %v", err)
+	}
+
+	var after uint64
+	if command == "DP" {
+		cursor, err := s.History.Cursor(user, plant)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cursor: %v", err)
+		}
+		after = cursor
+	}
+
+	session := sessionKey{user, plant, command}
+	if req.Reserved&RequestResume != 0 {
+		if last, ok := s.session(session); ok && last > after {
+			log.Printf("Resuming %s download for %s/%s after record %d", command, user, plant, last)
+			after = last
+		} else {
+			log.Printf("No interrupted %s download for %s/%s, starting over", command, user, plant)
+		}
+	}
+	s.setSession(session, after)
+
+	var records []HistoryRecord
+	if req.BlockSel&BlockSelMeasures == 0 {
+		log.Printf("Block select %08b does not include measures", req.BlockSel)
+	} else {
+		var err error
+		records, err = s.History.Records(plant, after, req.MaxRecords())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read history: %v", err)
+		}
+	}
+	if other := req.BlockSel &^ BlockSelMeasures; other != 0 {
+		log.Printf("Block select %08b: only measures are emulated, skipping other blocks", other)
+	}
+	if maxRec := req.MaxRecords(); maxRec > 0 {
+		log.Printf("Download limited to %d records", maxRec)
+	}
+
+	// Send header and wait for client to acknowledge it
+	ack, err := s.send(conn, fr, buildHeader(s.Clock.Now(), p, req), "header")
+	if err != nil {
+		return nil, err
+	}
+	if ack.Type == FrameRequest {
+		return nil, fmt.Errorf("request received while waiting for header ACK")
+	}
+	log.Printf("Sent Header block for %s request", command)
+
+	// Send measurements
+	for i, record := range records {
+		measurement := NewMeasurement()
+		measurement.Data = record.Data
+		measurement.CalculateMeasurementChecksum()
+		ack, err := s.send(conn, fr, measurementToBytes(measurement), "measurement")
+		if err != nil {
+			return nil, err
+		}
+		if ack.Type == FrameRequest {
+			return nil, fmt.Errorf("request received while waiting for measurement ACK")
+		}
+		log.Printf("Sent measurement %d/%d (record %d)", i+1, len(records), record.Seq)
+		s.setSession(session, record.Seq)
+	}
+
+	// Send final package, only an acknowledged Final moves the cursor
+	final := NewFinal()
+	final.CalculateFinalChecksum()
+	frame, err := s.send(conn, fr, final.Bytes(), "final package")
+	switch {
+	case err != nil:
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			log.Printf("Final package not acknowledged, cursor for %s/%s unchanged", user, plant)
+			return nil, nil
+		}
+		return nil, err
+
+	case frame.Type != FrameACK:
+		log.Printf("Final package not acknowledged (got %s), cursor for %s/%s unchanged", frame.Type, user, plant)
+		if frame.Type == FrameRequest {
+			return frame, nil
+		}
+		return nil, nil
+	}
+	log.Printf("Sent final package")
+	s.endSession(session)
+
+	// Only DP moves the cursor, and never backwards: a DT or a limited
+	// download may end before records already downloaded by a DP
+	if command == "DP" && len(records) > 0 {
+		last := records[len(records)-1].Seq
+		cursor, err := s.History.Cursor(user, plant)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cursor: %v", err)
+		}
+		if last > cursor {
+			if err := s.History.SetCursor(user, plant, last); err != nil {
+				return nil, fmt.Errorf("failed to update cursor: %v", err)
 			}
-			log.Printf("Sent final package")
+			log.Printf("Cursor for %s/%s moved to record %d", user, plant, last)
+		}
+	}
+	return nil, nil
+}
 
-		default:
-			log.Printf("Unknown command: %s", req.Command[:])
-			if _, err := conn.Write(BuildNAKResponse()); err != nil {
-				log.Printf("Failed to send NAK: %v", err)
+// AddPlant adds a plant routed by its Code, replacing any plant with the same
+// code
+func (s *Server) AddPlant(p *Plant) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Plants == nil {
+		s.Plants = make(map[string]*Plant)
+	}
+	s.Plants[p.Code] = p
+}
+
+// plantFor returns the plant a request is for, nil if there is none
+func (s *Server) plantFor(req *Request) *Plant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.Plants[string(req.PlantCode[:])]; ok {
+		return p
+	}
+	return s.Plant
+}
+
+func (s *Server) session(key sessionKey) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.sessions[key]
+	return last, ok
+}
+
+func (s *Server) setSession(key sessionKey, last uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[sessionKey]uint64)
+	}
+	s.sessions[key] = last
+}
+
+func (s *Server) endSession(key sessionKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, key)
+}
+
+// send writes a frame and waits for the client answer, resending the frame
+// each time it is refused with a NAK up to MaxRetries times. The answer is an
+// ACK, an MSR or a Request frame.
+func (s *Server) send(conn net.Conn, fr *FrameReader, frame []byte, name string) (*Frame, error) {
+	for retry := 0; ; retry++ {
+		if err := s.write(conn, frame); err != nil {
+			return nil, fmt.Errorf("failed to send %s: %v", name, err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(s.AckTimeout))
+		ack, err := s.readAck(fr)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				s.Stats.Timeouts.Add(1)
 			}
+			return nil, fmt.Errorf("failed to read %s ACK: %w", name, err)
+		}
+		if ack.Type != FrameNAK {
+			return ack, nil
 		}
+
+		s.Stats.NAKsReceived.Add(1)
+		if retry >= s.MaxRetries {
+			return nil, fmt.Errorf("%s refused after %d retries", name, retry)
+		}
+		s.Stats.Retransmissions.Add(1)
+		log.Printf("Client sent NAK for %s, resending (retry %d/%d)", name, retry+1, s.MaxRetries)
 	}
 }
 
-func BuildHeaderResponse(s *Server, req *Request) []byte {
-	header := NewHeader()
+// produce moves the simulated clock by Step and updates the plant, clocks
+// that cannot be stepped are left alone
+func (s *Server) produce(plant *Plant) error {
+	if clock, ok := s.Clock.(SteppedClock); ok && s.Step > 0 {
+		clock.Advance(s.Step)
+	}
+	return s.update(plant)
+}
 
-	// Copy relevant fields from request
-	copy(header.UserCode[:], req.UserCode[:])
-	copy(header.PlantCode[:], req.PlantCode[:])
+// update runs the plant simulation up to the current simulated time and
+// appends the new blocks to the plant history
+func (s *Server) update(plant *Plant) error {
+	now := s.Clock.Now()
+	blocks := plant.Advance(now)
+	if len(blocks) == 0 {
+		return nil
+	}
+	log.Printf("Plant %s produced %d blocks up to %s", plant.Code, len(blocks), now.Format(time.RFC3339))
+	return s.History.Append(plant.Code, now, blocks...)
+}
 
-	// Set current date and time
-	now := time.Now().In(s.Location)
-	copy(header.Day[:], intToBCD(now.Day()))
-	copy(header.Month[:], intToBCD(int(now.Month())))
-	copy(header.Year[:], intToBCD(now.Year()%100))
-	copy(header.Hour[:], intToBCD(now.Hour()))
-	copy(header.Minute[:], intToBCD(now.Minute()))
+// write sends a frame to the client
+func (s *Server) write(conn net.Conn, frame []byte) error {
+	if _, err := conn.Write(frame); err != nil {
+		return err
+	}
+	s.Stats.countFrameSent(frame)
+	return nil
+}
 
-	// Set default values
-	header.RAM = 0x01
-	copy(header.SWVersion[:], []byte{0x01, 0x02, 0x03, 0x04})
+// nak refuses the last frame or request received
+func (s *Server) nak(conn net.Conn) error {
+	if err := s.write(conn, BuildNAKResponse()); err != nil {
+		return err
+	}
+	s.Stats.NAKsSent.Add(1)
+	return nil
+}
 
-	// Calculate checksum
-	header.CalculateHeaderChecksum()
+// readFrame reads the next frame from the client
+func (s *Server) readFrame(fr *FrameReader) (*Frame, error) {
+	frame, err := fr.ReadFrame()
+	s.Stats.countFrameReceived(frame, err)
+	return frame, err
+}
 
-	// Convert to bytes with correct ordering
-	b := make([]byte, 35)
-	b[0] = header.STX
-	copy(b[1:3], header.Computer[:])
-	copy(b[3:5], header.IntestationBlock[:])
-	copy(b[5:7], header.Model[:])
-	copy(b[7:11], header.UserCode[:])
-	copy(b[11:15], header.PlantCode[:])
-	copy(b[15:17], header.Day[:])
-	copy(b[17:19], header.Month[:])
-	copy(b[19:23], header.Year[:])
-	copy(b[23:25], header.Hour[:])
-	copy(b[25:27], header.Minute[:])
-	b[27] = header.RAM
-	copy(b[28:32], header.SWVersion[:])
-	binary.BigEndian.PutUint16(b[32:34], binary.BigEndian.Uint16(header.Checksum[:]))
-	b[34] = header.ETB
-
-	// Verification (for debugging)
-	var sentSum uint16
-	for _, bt := range b[1:32] { // Changed from 33 to 32 - checksum covers bytes 1-31
-		sentSum += uint16(bt)
-	}
-	sentChecksum := binary.BigEndian.Uint16(b[32:34])
-	log.Printf("Server checksum verification: calculated=%d, sent=%d", sentSum, sentChecksum)
-
-	return b
-}
-
-// intToBCD converts an integer to BCD format (2 digits per byte)
-func intToBCD(n int) []byte {
-	// For numbers 0-99
-	return []byte{byte((n/10)<<4 | (n % 10))}
+// readAck reads frames until the peer acknowledges (ACK or MSR) or refuses
+// (NAK) the last frame sent, or sends a new request
+func (s *Server) readAck(fr *FrameReader) (*Frame, error) {
+	for {
+		frame, err := s.readFrame(fr)
+		if err != nil {
+			return nil, err
+		}
+		switch frame.Type {
+		case FrameACK, FrameMSR, FrameNAK, FrameRequest:
+			return frame, nil
+		}
+		log.Printf("Ignoring unexpected %s frame while waiting for ACK", frame.Type)
+	}
+}
+
+// RandomMeasurement returns a measurement with random content drawn from the
+// server random source
+func (s *Server) RandomMeasurement() *Measurement {
+	return newRandomMeasurement(s.Rand, s.Clock.Now().In(s.Location))
+}
+
+// BuildHeaderResponse builds the Header block answering req, for the plant
+// the request is routed to
+func BuildHeaderResponse(s *Server, req *Request) []byte {
+	p := s.plantFor(req)
+	if p == nil {
+		p = &Plant{Location: s.Location, SWVersion: DefaultSWVersion}
+	}
+	return buildHeader(s.Clock.Now(), p, req)
+}
+
+func buildHeader(now time.Time, p *Plant, req *Request) []byte {
+	info := HeaderInfo{
+		Time:      now.In(p.Location),
+		RAM:       true,
+		SWVersion: SWVersionOf(p.SWVersion),
+	}
+	header, err := info.Header()
+	if err != nil {
+		log.Printf("Header date not encoded: %v", err)
+		header = NewHeader()
+		header.RAM = 0x01
+		header.SWVersion = p.SWVersion
+	}
+
+	// The codes are echoed as received
+	header.UserCode = req.UserCode
+	header.PlantCode = req.PlantCode
+	header.CalculateHeaderChecksum()
+	return header.Bytes()
 }
 
 func (s *Server) Stop() {
@@ -243,4 +561,10 @@ func (s *Server) Stop() {
 	for conn := range s.Connections {
 		conn.Close()
 	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.adminServer != nil {
+		s.adminServer.Close()
+	}
 }
@@ -4,21 +4,161 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"FakeLPM/fakelpm"
+	"FakeLPM/fakelpm/storage"
 )
 
+// faultFlags collects repeated -fault options
+type faultFlags []fakelpm.Fault
+
+func (f *faultFlags) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *faultFlags) Set(spec string) error {
+	fault, err := fakelpm.ParseFault(spec)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, fault)
+	return nil
+}
+
+// credentialFlags collects repeated -auth options
+type credentialFlags []fakelpm.Credential
+
+func (c *credentialFlags) String() string {
+	return fmt.Sprint(*c)
+}
+
+func (c *credentialFlags) Set(spec string) error {
+	credential, err := fakelpm.ParseCredential(spec)
+	if err != nil {
+		return err
+	}
+	*c = append(*c, credential)
+	return nil
+}
+
 // Server
 func main() {
 	port := flag.Int("port", 5001, "Server port")
+	poles := flag.Int("poles", fakelpm.DefaultPoles, "Number of simulated poles")
+	historyDays := flag.Int("history", fakelpm.DefaultHistoryDays, "Days of history simulated at startup")
+	speed := flag.Float64("speed", 1, "Simulated clock speed relative to wall time")
+	seed := flag.Int64("seed", 0, "Random seed; when set the simulated clock is stopped at -start so sessions are reproducible")
+	start := flag.String("start", "2024-01-01T00:00:00", "Simulated start time (local time); the current time is used instead when not set outside seeded mode")
+	clockKind := flag.String("clock", "", "Simulated clock: real, fixed, manual or accelerated (by -speed); manual in seeded mode and accelerated otherwise when empty")
+	step := flag.Duration("step", 0, "Simulated time added on every download request")
+	retries := flag.Int("retries", fakelpm.DefaultMaxRetries, "Times a frame refused with NAK is resent before aborting")
+	faultFile := flag.String("faults", "", "JSON fault scenario file")
+	replay := flag.String("replay", "", "Capture file to play back to every client in place of the emulation")
+	reject := flag.String("reject", "nak", "What is done with requests with unknown codes: nak or close")
+	var credentials credentialFlags
+	flag.Var(&credentials, "auth", "UserCode:PlantCode pair allowed to download, any when none is given (repeatable)")
+	adminAddr := flag.String("admin", "", "Address of the admin HTTP API, e.g. :8081 (none when empty)")
+	metricsAddr := flag.String("metrics", "", "Address serving /metrics over HTTP, e.g. :9100 (none when empty)")
+	dbPath := flag.String("db", "", "SQLite database keeping the measurement history and download cursors across restarts")
+	configFile := flag.String("config", "", "JSON file of the listeners and plants to emulate (YAML is not supported); -db, -metrics, -fault and -faults still apply, the admin API is set per listener in the file and the other flags are ignored")
+	var faults faultFlags
+	flag.Var(&faults, "fault", "Fault to inject, kind[,frames=Header/Measurement/Final][,after=N][,prob=P][,count=N][,delay=D][,chunk=N] (repeatable)")
 	flag.Parse()
 
+	if *faultFile != "" {
+		scenario, err := fakelpm.LoadFaultScenario(*faultFile)
+		if err != nil {
+			log.Fatalf("Failed to load faults: %v", err)
+		}
+		faults = append(scenario.Faults, faults...)
+	}
+
+	var history fakelpm.HistoryStore
+	if *dbPath != "" {
+		db, err := storage.Open(*dbPath)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		defer db.Close()
+		history = db
+		log.Printf("History stored in %s", *dbPath)
+	}
+
+	if *configFile != "" {
+		runConfig(*configFile, faults, history, *metricsAddr)
+		return
+	}
+
+	seeded, started := false, false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "seed":
+			seeded = true
+		case "start":
+			started = true
+		}
+	})
+
 	// Start server
-	server, _ := fakelpm.New(fmt.Sprintf(":%d", *port))
+	server, err := fakelpm.New(fmt.Sprintf(":%d", *port))
+	if err != nil {
+		log.Fatalf("Server setup failed: %v", err)
+	}
+	server.Step = *step
+	server.Admin = *adminAddr
+	if history != nil {
+		server.History = history
+	}
+	server.MaxRetries = *retries
+	if err := server.SetCredentials(credentials); err != nil {
+		log.Fatalf("Invalid credentials: %v", err)
+	}
+	if server.Reject, err = fakelpm.ParseRejectAction(*reject); err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range credentials {
+		log.Printf("Downloads allowed for %s", c)
+	}
+	if *replay != "" {
+		if server.Replay, err = fakelpm.LoadCapture(*replay); err != nil {
+			log.Fatalf("Failed to load capture: %v", err)
+		}
+		log.Printf("Replaying %s (%d connections)", *replay, len(server.Replay.Conns()))
+	}
+	startTime := server.StartTime
+	if seeded || started {
+		if startTime, err = time.ParseInLocation("2006-01-02T15:04:05", *start, server.Location); err != nil {
+			log.Fatalf("Invalid start time: %v", err)
+		}
+	}
+	kind := *clockKind
+	if seeded {
+		server.Rand = rand.New(rand.NewSource(*seed))
+		if kind == "" {
+			kind = fakelpm.ClockManual
+		}
+		log.Printf("Seeded mode: seed %d", *seed)
+	} else if kind == "" {
+		kind = fakelpm.ClockAccelerated
+	}
+	if server.Clock, err = fakelpm.NewClock(kind, startTime, *speed); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Simulated clock: %s, starting at %s", kind, server.Clock.Now().Format(time.RFC3339))
+	simStart := server.Clock.Now().AddDate(0, 0, -*historyDays)
+	server.Plant = fakelpm.NewPlant("0000", *poles, simStart, rand.New(rand.NewSource(server.Rand.Int63())))
+
+	server.Faults = fakelpm.NewFaultInjector(faults, rand.New(rand.NewSource(server.Rand.Int63())))
+	for _, f := range faults {
+		log.Printf("Fault injection enabled: %s", f)
+	}
 	log.Printf("Server starting on port %d", *port)
+	serveMetrics(*metricsAddr, server)
 
 	// Graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -34,3 +174,60 @@ func main() {
 	log.Println("Shutting down server...")
 	server.Stop()
 }
+
+// runConfig runs the servers described by a config file, adding faults to
+// those of every listener. A non nil history is shared by all of them.
+func runConfig(path string, faults []fakelpm.Fault, history fakelpm.HistoryStore, metricsAddr string) {
+	config, err := fakelpm.LoadConfig(path)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	for i := range config.Listeners {
+		config.Listeners[i].Faults = append(config.Listeners[i].Faults, faults...)
+	}
+	servers, err := config.Servers()
+	if err != nil {
+		log.Fatalf("Server setup failed: %v", err)
+	}
+
+	collectors := make([]fakelpm.MetricsCollector, len(servers))
+	for i, server := range servers {
+		collectors[i] = server
+	}
+	serveMetrics(metricsAddr, collectors...)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	for _, server := range servers {
+		if history != nil {
+			server.History = history
+		}
+		for _, f := range server.Faults.Faults() {
+			log.Printf("Fault injection enabled on %s: %s", server.Addr, f)
+		}
+		go func() {
+			if err := server.Start(); err != nil {
+				log.Fatalf("Server %s failed: %v", server.Addr, err)
+			}
+		}()
+	}
+
+	<-sigChan
+	log.Println("Shutting down servers...")
+	for _, server := range servers {
+		server.Stop()
+	}
+}
+
+// serveMetrics serves the metrics of collectors on addr in the background,
+// when addr is set
+func serveMetrics(addr string, collectors ...fakelpm.MetricsCollector) {
+	if addr == "" {
+		return
+	}
+	log.Printf("Metrics served on http://%s/metrics", addr)
+	go func() {
+		log.Fatalf("Metrics server failed: %v", fakelpm.ServeMetrics(addr, collectors...))
+	}()
+}
@@ -0,0 +1,252 @@
+package fakelpm
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sink formats accepted by OpenSink
+const (
+	SinkJSONL = "jsonl"
+	SinkCSV   = "csv"
+)
+
+// Keys added to the map form of a reading by Record.Map
+const (
+	recordTargetTag    = "target"
+	recordUserTag      = "user"
+	recordPlantTag     = "plant"
+	recordReceivedTag  = "received"
+	recordTimestampTag = "timestamp"
+	recordClockSkewTag = "clock_skew" // seconds, only when corrected
+)
+
+// Map returns the record in the map form of LampReading.Map, with the
+// concentrator it was downloaded from
+func (r Record) Map() map[string]interface{} {
+	m := r.LampReading.Map()
+	m[recordTargetTag] = r.Target
+	m[recordUserTag] = r.UserCode
+	m[recordPlantTag] = r.PlantCode
+	m[recordReceivedTag] = r.Received
+	if r.ClockSkew != 0 {
+		m[recordClockSkewTag] = r.ClockSkew.Seconds()
+	}
+	return m
+}
+
+// NewRecords decodes the Data block of m into the records of the readings
+// it carries
+func NewRecords(target, user, plant string, m *Measurement, loc *time.Location) ([]Record, error) {
+	readings, err := DecodeLampBlock(m.Data[:], loc)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	records := make([]Record, len(readings))
+	for i, r := range readings {
+		records[i] = Record{
+			Target:      target,
+			UserCode:    user,
+			PlantCode:   plant,
+			Received:    now,
+			LampReading: r,
+		}
+	}
+	return records, nil
+}
+
+// SinkCloser is a Sink holding a resource, Close flushes and releases it
+type SinkCloser interface {
+	Sink
+	io.Closer
+}
+
+// OpenSink creates a sink of the given format writing to path, truncated if
+// it exists. Path "-" is the standard output.
+func OpenSink(format, path string) (SinkCloser, error) {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	switch format {
+	case SinkJSONL:
+		return NewJSONLSink(w), nil
+	case SinkCSV:
+		return NewCSVSink(w), nil
+	}
+	if c, ok := w.(io.Closer); ok && path != "-" {
+		c.Close()
+	}
+	return nil, fmt.Errorf("unknown sink format %q", format)
+}
+
+// JSONLSink writes every record as a line of JSON in the map form of
+// Record.Map
+type JSONLSink struct {
+	mu  sync.Mutex
+	out io.Writer
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func NewJSONLSink(w io.Writer) *JSONLSink {
+	bw := bufio.NewWriter(w)
+	return &JSONLSink{out: w, w: bw, enc: json.NewEncoder(bw)}
+}
+
+// Write writes the records and flushes them, so that a block is acknowledged
+// only once its records are out
+func (s *JSONLSink) Write(ctx context.Context, records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range records {
+		if err := s.enc.Encode(r.Map()); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+// Close flushes the sink and closes the underlying writer, unless it is the
+// standard output
+func (s *JSONLSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return closeSinkWriter(s.out, s.w.Flush())
+}
+
+// csvColumns are the columns written by a CSVSink, keys of Record.Map
+var csvColumns = append(append([]string{
+	recordTargetTag,
+	recordUserTag,
+	recordPlantTag,
+	recordReceivedTag,
+	LPM_lamp_address_tag,
+	recordTimestampTag,
+	LPM_lamp_measure_state_not_responding,
+}, lampFlagNames...),
+	LPM_lamp_measure_voltage,
+	LPM_lamp_measure_current,
+	LPM_lamp_measure_cosfi,
+	LPM_lamp_measure_active_power,
+	LPM_lamp_measure_energy,
+	LPM_lamp_measure_time_lamp_powered,
+	LPM_lamp_measure_time_lamp_poweron,
+	recordClockSkewTag,
+)
+
+// CSVSink writes records as CSV rows under a header row. Values missing from
+// a reading, such as the energy of a power measure, are left empty.
+type CSVSink struct {
+	mu     sync.Mutex
+	out    io.Writer
+	w      *csv.Writer
+	header bool
+}
+
+func NewCSVSink(w io.Writer) *CSVSink {
+	return &CSVSink{out: w, w: csv.NewWriter(w)}
+}
+
+// Write writes the records and flushes them, preceded by the header row on
+// the first call
+func (s *CSVSink) Write(ctx context.Context, records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.header {
+		if err := s.w.Write(csvColumns); err != nil {
+			return err
+		}
+		s.header = true
+	}
+
+	row := make([]string, len(csvColumns))
+	for _, r := range records {
+		m := r.Map()
+		for i, col := range csvColumns {
+			row[i] = csvValue(m[col])
+		}
+		if err := s.w.Write(row); err != nil {
+			return err
+		}
+	}
+	s.w.Flush()
+	return s.w.Error()
+}
+
+// Close flushes the sink and closes the underlying writer, unless it is the
+// standard output
+func (s *CSVSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Flush()
+	return closeSinkWriter(s.out, s.w.Error())
+}
+
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
+
+func closeSinkWriter(w io.Writer, err error) error {
+	c, ok := w.(io.Closer)
+	if !ok || w == os.Stdout {
+		return err
+	}
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ChanSink sends every record on a channel, blocking until it is received or
+// the context is done. The channel is never closed by the sink.
+type ChanSink chan<- Record
+
+func (c ChanSink) Write(ctx context.Context, records []Record) error {
+	for _, r := range records {
+		select {
+		case c <- r:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// MultiSink writes records to every sink in turn, stopping at the first
+// error
+type MultiSink []Sink
+
+func (m MultiSink) Write(ctx context.Context, records []Record) error {
+	for _, s := range m {
+		if err := s.Write(ctx, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package fakelpm
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats counts protocol events on one side of a connection
+type Stats struct {
+	NAKsSent         atomic.Int64
+	NAKsReceived     atomic.Int64
+	Retransmissions  atomic.Int64
+	AuthRejects      atomic.Int64 // requests refused for unknown codes
+	ChecksumFailures atomic.Int64 // frames received with a bad checksum
+	Timeouts         atomic.Int64 // answers the peer did not send in time
+	ClockSkewAlerts  atomic.Int64 // Headers with a clock skew beyond the threshold
+
+	mu             sync.Mutex
+	requests       map[string]int64
+	framesSent     map[FrameType]int64
+	framesReceived map[FrameType]int64
+	downloads      map[downloadKey]*histogram
+}
+
+// downloadKey labels the download durations
+type downloadKey struct {
+	command string
+	result  string
+}
+
+// DownloadBuckets are the upper bounds, in seconds, of the download duration
+// histograms
+var DownloadBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// histogram counts observations in DownloadBuckets
+type histogram struct {
+	buckets []int64 // not cumulative, the last one is +Inf
+	count   int64
+	sum     float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.buckets == nil {
+		h.buckets = make([]int64, len(DownloadBuckets)+1)
+	}
+	i := 0
+	for i < len(DownloadBuckets) && v > DownloadBuckets[i] {
+		i++
+	}
+	h.buckets[i]++
+	h.count++
+	h.sum += v
+}
+
+// countRequest counts a request, commands other than DT and DP are
+// counted as "unknown"
+func (st *Stats) countRequest(command string) {
+	if command != "DT" && command != "DP" {
+		command = "unknown"
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.requests == nil {
+		st.requests = make(map[string]int64)
+	}
+	st.requests[command]++
+}
+
+// countFrameSent counts the frame in b, frames are told apart as a FrameReader
+// does
+func (st *Stats) countFrameSent(b []byte) {
+	frameType := frameTypeOf(b)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.framesSent == nil {
+		st.framesSent = make(map[FrameType]int64)
+	}
+	st.framesSent[frameType]++
+}
+
+// countFrameReceived counts the outcome of a FrameReader.ReadFrame call, invalid
+// frames are counted with their type
+func (st *Stats) countFrameReceived(frame *Frame, err error) {
+	var frameType FrameType
+	var ferr *FrameError
+	switch {
+	case frame != nil:
+		frameType = frame.Type
+	case errors.As(err, &ferr):
+		frameType = ferr.Type
+		if errors.Is(ferr, ErrChecksum) {
+			st.ChecksumFailures.Add(1)
+		}
+	default:
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.framesReceived == nil {
+		st.framesReceived = make(map[FrameType]int64)
+	}
+	st.framesReceived[frameType]++
+}
+
+// countDownload records the duration of a download, result is "ok" or
+// "failed"
+func (st *Stats) countDownload(command, result string, d time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.downloads == nil {
+		st.downloads = make(map[downloadKey]*histogram)
+	}
+	key := downloadKey{command, result}
+	h := st.downloads[key]
+	if h == nil {
+		h = &histogram{}
+		st.downloads[key] = h
+	}
+	h.observe(d.Seconds())
+}
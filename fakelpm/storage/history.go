@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"FakeLPM/fakelpm"
+)
+
+var _ fakelpm.HistoryStore = (*DB)(nil)
+
+// Append implements fakelpm.HistoryStore, the UNIQUE (plant, data)
+// constraint skips the blocks already stored
+func (d *DB) Append(plant string, produced time.Time, data ...[48]byte) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var seq uint64
+	err = tx.QueryRow("SELECT seq FROM history_seq WHERE plant = ?", plant).Scan(&seq)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO history (plant, seq, produced, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (plant, data) DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, block := range data {
+		res, err := stmt.Exec(plant, seq+1, produced.UnixMilli(), block[:])
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			seq++
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO history_seq (plant, seq) VALUES (?, ?)
+		ON CONFLICT (plant) DO UPDATE SET seq = excluded.seq`, plant, seq)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Records implements fakelpm.HistoryStore
+func (d *DB) Records(plant string, after uint64, limit int) ([]fakelpm.HistoryRecord, error) {
+	query := "SELECT seq, produced, data FROM history WHERE plant = ? AND seq > ? ORDER BY seq"
+	args := []interface{}{plant, after}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []fakelpm.HistoryRecord
+	for rows.Next() {
+		var r fakelpm.HistoryRecord
+		var produced int64
+		var data []byte
+		if err := rows.Scan(&r.Seq, &produced, &data); err != nil {
+			return nil, err
+		}
+		r.Produced = time.UnixMilli(produced)
+		copy(r.Data[:], data)
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// Cursor implements fakelpm.HistoryStore
+func (d *DB) Cursor(user, plant string) (uint64, error) {
+	var seq uint64
+	err := d.db.QueryRow("SELECT seq FROM cursors WHERE user = ? AND plant = ?", user, plant).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// SetCursor implements fakelpm.HistoryStore
+func (d *DB) SetCursor(user, plant string, seq uint64) error {
+	_, err := d.db.Exec(`INSERT INTO cursors (user, plant, seq) VALUES (?, ?, ?)
+		ON CONFLICT (user, plant) DO UPDATE SET seq = excluded.seq`, user, plant, seq)
+	return err
+}
+
+// Clear implements fakelpm.HistoryStore
+func (d *DB) Clear(plant string) error {
+	_, err := d.db.Exec("DELETE FROM history WHERE plant = ?", plant)
+	return err
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"FakeLPM/fakelpm"
+)
+
+func openTest(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestOpenPragmas(t *testing.T) {
+	db := openTest(t)
+
+	tests := []struct {
+		pragma string
+		want   string
+	}{
+		{"journal_mode", "wal"},
+		{"busy_timeout", "5000"},
+		{"synchronous", "1"}, // NORMAL
+	}
+	for _, tt := range tests {
+		var got string
+		if err := db.db.QueryRow("PRAGMA " + tt.pragma).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.pragma, got, tt.want)
+		}
+	}
+}
+
+// TestHistoryStores runs the same appends on both stores, which must keep
+// the same records
+func TestHistoryStores(t *testing.T) {
+	stores := map[string]fakelpm.HistoryStore{
+		"memory": fakelpm.NewMemoryHistory(),
+		"sqlite": openTest(t),
+	}
+
+	block := func(b byte) [48]byte {
+		var d [48]byte
+		d[0] = b
+		return d
+	}
+	now := time.UnixMilli(time.Now().UnixMilli())
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			steps := []struct {
+				blocks []byte
+				clear  bool
+			}{
+				{blocks: []byte{1, 2}},
+				{blocks: []byte{2, 3, 3}}, // 2 and the second 3 are already there
+				{clear: true},
+				{blocks: []byte{1}}, // cleared, so it is new again
+			}
+			for _, step := range steps {
+				if step.clear {
+					if err := store.Clear("0001"); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				var data [][48]byte
+				for _, b := range step.blocks {
+					data = append(data, block(b))
+				}
+				if err := store.Append("0001", now, data...); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			records, err := store.Records("0001", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 || records[0].Seq != 4 || records[0].Data != block(1) {
+				t.Fatalf("got %+v, want block 1 as record 4", records)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+// Package storage keeps decoded lamp readings, and the measurement history
+// of the fake server, in a SQLite database file.
+//
+// Readings are deduplicated on plant, lamp address and timestamp: storing a
+// reading again replaces the stored one, so a block downloaded twice (a DT
+// after a DP, a resumed download) leaves a single copy. A DB is a
+// fakelpm.Sink for the poller and a fakelpm.HistoryStore for the server.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"FakeLPM/fakelpm"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order, the schema version of a database is the
+// number of migrations applied to it
+var migrations = []string{
+	`CREATE TABLE readings (
+		plant           TEXT    NOT NULL,
+		address         INTEGER NOT NULL,
+		timestamp       INTEGER NOT NULL, -- Unix seconds
+		target          TEXT    NOT NULL,
+		user            TEXT    NOT NULL,
+		received        INTEGER NOT NULL, -- Unix milliseconds
+		status          INTEGER NOT NULL,
+		measure_type    INTEGER NOT NULL,
+		conversion_type INTEGER NOT NULL,
+		not_responding  INTEGER NOT NULL,
+		flags           INTEGER NOT NULL,
+		voltage         REAL    NOT NULL,
+		current         REAL    NOT NULL,
+		cosfi           REAL    NOT NULL,
+		active_power    REAL    NOT NULL,
+		energy          REAL,             -- NULL without energy
+		powered         INTEGER,          -- seconds, NULL without durations
+		lit             INTEGER,
+		PRIMARY KEY (plant, address, timestamp)
+	) WITHOUT ROWID`,
+
+	`CREATE TABLE history (
+		plant    TEXT    NOT NULL,
+		seq      INTEGER NOT NULL,
+		produced INTEGER NOT NULL, -- Unix milliseconds
+		data     BLOB    NOT NULL,
+		PRIMARY KEY (plant, seq),
+		UNIQUE (plant, data)
+	);
+	CREATE TABLE cursors (
+		user  TEXT    NOT NULL,
+		plant TEXT    NOT NULL,
+		seq   INTEGER NOT NULL,
+		PRIMARY KEY (user, plant)
+	)`,
+
+	// The last Seq of a plant survives the records cleared
+	`CREATE TABLE history_seq (
+		plant TEXT    NOT NULL PRIMARY KEY,
+		seq   INTEGER NOT NULL
+	);
+	INSERT INTO history_seq (plant, seq) SELECT plant, MAX(seq) FROM history GROUP BY plant`,
+}
+
+// DB is a SQLite database of lamp readings
+type DB struct {
+	db *sql.DB
+}
+
+// Open opens the database at path, creating it if needed, and brings its
+// schema up to date
+func Open(path string) (*DB, error) {
+	// The pragmas are part of the DSN so that every connection the pool
+	// opens gets them, not just the first one
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, one connection spares busy errors
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+
+	d := &DB{db: db}
+	if err := d.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migration of %s failed: %v", path, err)
+	}
+	return d, nil
+}
+
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// Version returns the schema version of the database
+func (d *DB) Version() (int, error) {
+	var version int
+	err := d.db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+func (d *DB) migrate() error {
+	version, err := d.Version()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than this program (%d)", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := d.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("version %d: %v", version+1, err)
+		}
+		// PRAGMA does not take parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const upsertReading = `INSERT INTO readings (
+	plant, address, timestamp, target, user, received, status, measure_type,
+	conversion_type, not_responding, flags, voltage, current, cosfi,
+	active_power, energy, powered, lit
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (plant, address, timestamp) DO UPDATE SET
+	target = excluded.target,
+	user = excluded.user,
+	received = excluded.received,
+	status = excluded.status,
+	measure_type = excluded.measure_type,
+	conversion_type = excluded.conversion_type,
+	not_responding = excluded.not_responding,
+	flags = excluded.flags,
+	voltage = excluded.voltage,
+	current = excluded.current,
+	cosfi = excluded.cosfi,
+	active_power = excluded.active_power,
+	energy = excluded.energy,
+	powered = excluded.powered,
+	lit = excluded.lit`
+
+// Write stores records in a single transaction, replacing the readings
+// already stored for the same plant, lamp and timestamp
+func (d *DB) Write(ctx context.Context, records []fakelpm.Record) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, upsertReading)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		var energy, powered, lit interface{}
+		if r.HasEnergy {
+			energy = r.Energy
+		}
+		if r.HasDurations {
+			powered = int64(r.Powered.Seconds())
+			lit = int64(r.Lit.Seconds())
+		}
+		_, err := stmt.ExecContext(ctx,
+			r.PlantCode, r.Address, r.Timestamp.Unix(), r.Target, r.UserCode,
+			r.Received.UnixMilli(), r.Status, r.MeasureType, r.ConversionType,
+			r.NotResponding, uint8(r.Flags), r.Voltage, r.Current, r.Cosfi,
+			r.ActivePower, energy, powered, lit)
+		if err != nil {
+			return fmt.Errorf("lamp %d at %s: %v", r.Address, r.Timestamp.Format(time.RFC3339), err)
+		}
+	}
+	return tx.Commit()
+}
+
+// WriteBlocks decodes Data blocks downloaded from target and stores their
+// readings. loc is the time zone of the concentrator.
+func (d *DB) WriteBlocks(ctx context.Context, target, user, plant string, loc *time.Location, blocks ...[48]byte) error {
+	var records []fakelpm.Record
+	for i := range blocks {
+		r, err := fakelpm.NewRecords(target, user, plant, &fakelpm.Measurement{Data: blocks[i]}, loc)
+		if err != nil {
+			return fmt.Errorf("block %d: %v", i, err)
+		}
+		records = append(records, r...)
+	}
+	return d.Write(ctx, records)
+}
+
+// WriteHistorical decodes measures in the base64 historical format (see
+// fakelpm.DecodeLampReadings) and stores them
+func (d *DB) WriteHistorical(ctx context.Context, target, user, plant, base64Data string, loc *time.Location) error {
+	readings, err := fakelpm.DecodeLampReadings(base64Data, loc)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	records := make([]fakelpm.Record, len(readings))
+	for i, r := range readings {
+		records[i] = fakelpm.Record{
+			Target:      target,
+			UserCode:    user,
+			PlantCode:   plant,
+			Received:    now,
+			LampReading: r,
+		}
+	}
+	return d.Write(ctx, records)
+}
+
+// Query selects stored readings, zero fields match everything
+type Query struct {
+	Plant string
+	Pole  int       // lamp address
+	From  time.Time // inclusive
+	To    time.Time // exclusive
+	Limit int
+}
+
+// Readings returns the readings matching q ordered by plant, timestamp and
+// lamp address. Times are in the local time zone.
+func (d *DB) Readings(ctx context.Context, q Query) ([]fakelpm.Record, error) {
+	query := `SELECT plant, address, timestamp, target, user, received, status,
+		measure_type, conversion_type, not_responding, flags, voltage, current,
+		cosfi, active_power, energy, powered, lit
+		FROM readings WHERE 1 = 1`
+	var args []interface{}
+	if q.Plant != "" {
+		query += " AND plant = ?"
+		args = append(args, q.Plant)
+	}
+	if q.Pole != 0 {
+		query += " AND address = ?"
+		args = append(args, q.Pole)
+	}
+	if !q.From.IsZero() {
+		query += " AND timestamp >= ?"
+		args = append(args, q.From.Unix())
+	}
+	if !q.To.IsZero() {
+		query += " AND timestamp < ?"
+		args = append(args, q.To.Unix())
+	}
+	query += " ORDER BY plant, timestamp, address"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []fakelpm.Record
+	for rows.Next() {
+		var r fakelpm.Record
+		var timestamp, received int64
+		var flags uint8
+		var energy sql.NullFloat64
+		var powered, lit sql.NullInt64
+		err := rows.Scan(&r.PlantCode, &r.Address, &timestamp, &r.Target, &r.UserCode,
+			&received, &r.Status, &r.MeasureType, &r.ConversionType, &r.NotResponding,
+			&flags, &r.Voltage, &r.Current, &r.Cosfi, &r.ActivePower, &energy, &powered, &lit)
+		if err != nil {
+			return nil, err
+		}
+		r.Timestamp = time.Unix(timestamp, 0)
+		r.Received = time.UnixMilli(received)
+		r.Flags = fakelpm.LampFlags(flags)
+		if energy.Valid {
+			r.HasEnergy = true
+			r.Energy = energy.Float64
+		}
+		if powered.Valid && lit.Valid {
+			r.HasDurations = true
+			r.Powered = time.Duration(powered.Int64) * time.Second
+			r.Lit = time.Duration(lit.Int64) * time.Second
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
@@ -0,0 +1,75 @@
+package fakelpm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DescribeFrame returns a human readable summary of a frame: a first line
+// naming the frame and its main fields, then one indented line per lamp
+// reading for measurement frames. loc is used to decode block timestamps.
+func DescribeFrame(f *Frame, loc *time.Location) string {
+	switch f.Type {
+	case FrameRequest:
+		r := f.Request
+		s := fmt.Sprintf("Request %s user=%q plant=%q blocksel=%08b maxrec=%d",
+			r.Command[:], r.UserCode[:], r.PlantCode[:], r.BlockSel, r.MaxRecords())
+		if r.Reserved&RequestResume != 0 {
+			s += " resume"
+		}
+		return s
+
+	case FrameHeader:
+		h := f.Header
+		info, err := h.Info(loc)
+		if err != nil {
+			return fmt.Sprintf("Header user=%q plant=%q date=%X/%X/%X time=%X:%X ram=%d sw=%v (%v)",
+				h.UserCode[:], h.PlantCode[:], h.Day[:], h.Month[:], h.Year[:],
+				h.Hour[:], h.Minute[:], h.RAM, h.SWVersion[:], err)
+		}
+		return fmt.Sprintf("Header user=%q plant=%q time=%s ram=%t sw=%s",
+			info.UserCode, info.PlantCode, info.Time.Format("2006-01-02 15:04"), info.RAM, info.SWVersion)
+
+	case FrameMeasurement:
+		return describeMeasurement(f.Measurement, loc)
+
+	case FrameFinal:
+		return fmt.Sprintf("Final %s", f.Final.EndDownload[:])
+	}
+	return f.Type.String()
+}
+
+func describeMeasurement(m *Measurement, loc *time.Location) string {
+	readings, err := DecodeLampBlock(m.Data[:], loc)
+	if err != nil {
+		return fmt.Sprintf("Measurement undecodable block %X: %v", m.Data[:], err)
+	}
+	if len(readings) == 0 {
+		return "Measurement empty block"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Measurement lamp %d night of %s status=%08b",
+		readings[0].Address, readings[0].Timestamp.Format("2006-01-02"), readings[0].Status)
+	for _, r := range readings {
+		b.WriteString("\n    ")
+		b.WriteString(describeReading(r))
+	}
+	return b.String()
+}
+
+func describeReading(r LampReading) string {
+	if r.NotResponding {
+		return "not responding"
+	}
+	s := fmt.Sprintf("%s %s %.0fV %.2fA cosfi=%.2f %.1fW",
+		r.Timestamp.Format("15:04"), r.Flags, r.Voltage, r.Current, r.Cosfi, r.ActivePower)
+	if r.HasEnergy {
+		s += fmt.Sprintf(" energy=%.0fWh", r.Energy)
+	}
+	if r.HasDurations {
+		s += fmt.Sprintf(" powered=%.0fh lit=%.0fh", r.Powered.Hours(), r.Lit.Hours())
+	}
+	return s
+}